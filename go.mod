@@ -2,4 +2,7 @@ module bitTorrent
 
 go 1.25.7
 
-require github.com/jackpal/bencode-go v1.0.2
+require (
+	github.com/jackpal/bencode-go v1.0.2
+	golang.org/x/net v0.57.0
+)
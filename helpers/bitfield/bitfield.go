@@ -5,11 +5,38 @@ type Bitfield []byte
 func (bt Bitfield) CheckPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(bt) {
+		return false
+	}
 	return bt[byteIndex]>>(7-offset)&1 != 0
 }
 
-func (bt Bitfield) SetPiece(index int) {
+// Reports whether the bit went from 0 to 1, so repeated Haves can be ignored
+func (bt Bitfield) SetPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(bt) {
+		return false
+	}
+	if bt[byteIndex]>>(7-offset)&1 != 0 {
+		return false
+	}
 	bt[byteIndex] |= 1 << (7 - offset)
+	return true
+}
+
+func (bt Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bt) {
+		return
+	}
+	bt[byteIndex] &^= 1 << (7 - offset)
+}
+
+// Zeroes the bits past the last piece, peers drop connections whose bitfield has any set
+func (bt Bitfield) ClearSpare(numPieces int) {
+	for index := numPieces; index < len(bt)*8; index++ {
+		bt.ClearPiece(index)
+	}
 }
@@ -0,0 +1,44 @@
+package bitfield
+
+import "testing"
+
+func TestBoundaries(t *testing.T) {
+	// 10 pieces need 2 bytes, the last 6 bits of the second byte are spare
+	bf := make(Bitfield, 2)
+	const numPieces = 10
+
+	if !bf.SetPiece(numPieces - 1) {
+		t.Fatal("setting the last piece reported no change")
+	}
+	if !bf.CheckPiece(numPieces - 1) {
+		t.Error("last piece is not set")
+	}
+	if bf[1] != 0x40 {
+		t.Errorf("second byte is %08b, want 01000000", bf[1])
+	}
+	if bf.SetPiece(numPieces - 1) {
+		t.Error("setting the last piece twice reported a change")
+	}
+
+	// The very last bit of the slice, past numPieces but still inside it
+	if !bf.SetPiece(15) || !bf.CheckPiece(15) {
+		t.Error("bit 15 can not be set")
+	}
+	bf.ClearSpare(numPieces)
+	if bf.CheckPiece(15) || !bf.CheckPiece(numPieces-1) {
+		t.Errorf("ClearSpare left %08b", bf[1])
+	}
+
+	for _, index := range []int{-1, 16, 100} {
+		if bf.SetPiece(index) {
+			t.Errorf("SetPiece(%d) reported a change", index)
+		}
+		if bf.CheckPiece(index) {
+			t.Errorf("CheckPiece(%d) is true", index)
+		}
+		bf.ClearPiece(index)
+	}
+	if bf[0] != 0 || bf[1] != 0x40 {
+		t.Errorf("out of range calls changed the bitfield to %08b", []byte(bf))
+	}
+}
@@ -0,0 +1,184 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+type ipRange struct {
+	start netip.Addr
+	end   netip.Addr
+}
+
+// Filter holds sorted, non overlapping address ranges so lookups are a binary search
+type Filter struct {
+	ranges []ipRange
+}
+
+func Load(path string) (*Filter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Parse reads one rule per line in any of these forms:
+//
+//	1.2.3.0 - 1.2.3.255 , 000 , description   (eMule / PeerGuardian .dat)
+//	description:1.2.3.0-1.2.3.255             (PeerGuardian .p2p)
+//	1.2.3.0/24                                (CIDR)
+//	1.2.3.4                                   (single address)
+//
+// Blank lines and lines starting with # or // are skipped.
+func Parse(r io.Reader) (*Filter, error) {
+	f := &Filter{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		f.ranges = append(f.ranges, rng)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	f.normalize()
+	return f, nil
+}
+
+func parseLine(line string) (ipRange, error) {
+	// .p2p lines start with a description that may hold commas and colons of its own,
+	// the IPv4 range after the last colon is what marks the format
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Contains(line[i:], "-") {
+		if rng, err := parseRange(line[i+1:]); err == nil && rng.start.Is4() {
+			return rng, nil
+		}
+	}
+	// .dat lines carry a level and description after commas
+	if i := strings.Index(line, ","); i >= 0 {
+		line = line[:i]
+	}
+	return parseRange(line)
+}
+
+// A CIDR prefix, a start-end range or a single address
+func parseRange(line string) (ipRange, error) {
+	line = strings.TrimSpace(line)
+	if strings.Contains(line, "/") {
+		prefix, err := netip.ParsePrefix(line)
+		if err != nil {
+			return ipRange{}, err
+		}
+		prefix = prefix.Masked()
+		return ipRange{prefix.Addr().Unmap(), lastAddr(prefix).Unmap()}, nil
+	}
+
+	if start, end, ok := strings.Cut(line, "-"); ok {
+		startAddr, err := parseAddr(start)
+		if err != nil {
+			return ipRange{}, err
+		}
+		endAddr, err := parseAddr(end)
+		if err != nil {
+			return ipRange{}, err
+		}
+		if endAddr.Less(startAddr) || startAddr.Is4() != endAddr.Is4() {
+			return ipRange{}, fmt.Errorf("invalid range %q", line)
+		}
+		return ipRange{startAddr, endAddr}, nil
+	}
+
+	addr, err := parseAddr(line)
+	if err != nil {
+		return ipRange{}, err
+	}
+	return ipRange{addr, addr}, nil
+}
+
+// Accepts zero padded IPv4 like 001.002.003.004 which netip rejects
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ".")
+	if len(parts) == 4 {
+		for i, part := range parts {
+			trimmed := strings.TrimLeft(part, "0")
+			if trimmed == "" {
+				trimmed = "0"
+			}
+			parts[i] = trimmed
+		}
+		s = strings.Join(parts, ".")
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 1 << (7 - bit%8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+func (f *Filter) normalize() {
+	sort.Slice(f.ranges, func(i, j int) bool { return f.ranges[i].start.Less(f.ranges[j].start) })
+	merged := f.ranges[:0]
+	for _, rng := range f.ranges {
+		if n := len(merged); n > 0 && merged[n-1].start.Is4() == rng.start.Is4() {
+			last := &merged[n-1]
+			if !last.end.Less(rng.start) || last.end.Next() == rng.start {
+				if last.end.Less(rng.end) {
+					last.end = rng.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, rng)
+	}
+	f.ranges = merged
+}
+
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.ranges)
+}
+
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	// First range starting after addr, the candidate is the one before it
+	i := sort.Search(len(f.ranges), func(i int) bool { return addr.Less(f.ranges[i].start) })
+	if i == 0 {
+		return false
+	}
+	rng := f.ranges[i-1]
+	return !rng.end.Less(addr)
+}
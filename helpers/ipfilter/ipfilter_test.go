@@ -0,0 +1,142 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		start, end string
+	}{
+		{"1.2.3.0 - 1.2.3.255 , 000 , Some ISP", "1.2.3.0", "1.2.3.255"},
+		{"001.002.003.000 - 001.002.003.255 , 100 , Padded", "1.2.3.0", "1.2.3.255"},
+		{"1.2.3.0 - 1.2.3.255 , 000 , Time: 12:30", "1.2.3.0", "1.2.3.255"},
+		{"1.2.3.0 - 1.2.3.255 , 000 , self-described", "1.2.3.0", "1.2.3.255"},
+		{"Some ISP:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255"},
+		{"Acme, Inc., Widgets, Ltd:5.6.7.8-5.6.7.9", "5.6.7.8", "5.6.7.9"},
+		{"Bad: guys, really:10.0.0.1-10.0.0.2", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.0/8", "10.0.0.0", "10.255.255.255"},
+		{"10.1.2.3/8", "10.0.0.0", "10.255.255.255"},
+		{"192.168.1.1", "192.168.1.1", "192.168.1.1"},
+		{"::ffff:1.2.3.4", "1.2.3.4", "1.2.3.4"},
+		{"::ffff:1.2.3.4 - ::ffff:1.2.3.9", "1.2.3.4", "1.2.3.9"},
+		{"::ffff:1.2.3.0/120", "1.2.3.0", "1.2.3.255"},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"2001:db8::1 - 2001:db8::ff , 000 , v6-range", "2001:db8::1", "2001:db8::ff"},
+		{"2001:db8::5", "2001:db8::5", "2001:db8::5"},
+	}
+	for _, tt := range tests {
+		rng, err := parseLine(tt.line)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if rng.start.String() != tt.start || rng.end.String() != tt.end {
+			t.Errorf("%q parsed as %s-%s, want %s-%s", tt.line, rng.start, rng.end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestParseLineRejects(t *testing.T) {
+	for _, line := range []string{
+		"1.2.3.9 - 1.2.3.0",
+		"1.2.3.4 - 2001:db8::1",
+		"Description:1.2.3.4-",
+		"not an address",
+		"1.2.3.0/33",
+	} {
+		if rng, err := parseLine(line); err == nil {
+			t.Errorf("%q parsed as %s-%s, want an error", line, rng.start, rng.end)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	list := `# comment
+// another comment
+
+1.2.3.0 - 1.2.3.255 , 000 , Some ISP, with commas
+Acme, Inc:5.6.7.8-5.6.7.20
+10.0.0.0/8
+2001:db8::/32
+`
+	f, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 4 {
+		t.Errorf("got %d ranges, want 4", f.Len())
+	}
+
+	_, err = Parse(strings.NewReader("1.2.3.4\nnonsense\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("got %v, want an error on line 2", err)
+	}
+}
+
+func TestNormalizeMergesRanges(t *testing.T) {
+	list := `
+10.0.0.50 - 10.0.0.60
+10.0.0.0 - 10.0.0.100
+10.0.0.101 - 10.0.0.150
+10.0.0.140 - 10.0.0.200
+10.0.1.0 - 10.0.1.10
+::ffff:10.0.1.11
+2001:db8::1 - 2001:db8::10
+2001:db8::11 - 2001:db8::20
+`
+	f, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0-10.0.0.200", "10.0.1.0-10.0.1.11", "2001:db8::1-2001:db8::20"}
+	var got []string
+	for _, rng := range f.ranges {
+		got = append(got, rng.start.String()+"-"+rng.end.String())
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got ranges %v, want %v", got, want)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	f, err := Parse(strings.NewReader("1.2.3.10 - 1.2.3.20\n1.2.3.30\n255.255.255.0/24\n2001:db8::/126\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"0.0.0.0", false},
+		{"1.2.3.9", false},
+		{"1.2.3.10", true},
+		{"1.2.3.15", true},
+		{"1.2.3.20", true},
+		{"1.2.3.21", false},
+		{"1.2.3.29", false},
+		{"1.2.3.30", true},
+		{"1.2.3.31", false},
+		{"::ffff:1.2.3.10", true},
+		{"255.255.254.255", false},
+		{"255.255.255.255", true},
+		{"2001:db8::", true},
+		{"2001:db8::3", true},
+		{"2001:db8::4", false},
+		// The IPv4 range must not cover the IPv6 addresses sorting next to it
+		{"::1.2.3.15", false},
+	}
+	for _, tt := range tests {
+		if got := f.Blocked(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("Blocked(%s) = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+
+	var none *Filter
+	if none.Blocked(net.ParseIP("1.2.3.15")) || none.Len() != 0 {
+		t.Error("a nil Filter must block nothing")
+	}
+}
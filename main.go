@@ -1,26 +1,152 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 
+	"bitTorrent/helpers/ipfilter"
 	"bitTorrent/torrent"
 )
 
-const port = 6881
+func runRecheck(torrentData *torrent.TorrentFile, cfg torrent.Config, dir string) {
+	path := filepath.Join(dir, torrentData.Name)
+	_, err := os.Stat(path)
+	if err != nil {
+		_, err = os.Stat(path + torrent.PartialSuffix)
+	}
+	if err != nil {
+		log.Fatalf("Nothing To Recheck %s", err)
+	}
+
+	t := torrentData.ToTorrent(nil, [20]byte{})
+	t.Config = cfg
+	t.Config.ReuseExisting = true
+	storage, err := torrent.NewStorage(dir, t)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer storage.Close()
 
-func saveToOs(name string, data []byte) error {
-	return os.WriteFile(name, data, 0o644)
+	passed, failed, err := t.Recheck(storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Recheck Finished For %s: %d Pieces Passed, %d Pieces Failed\n", t.Name, passed, failed)
 }
 
 func main() {
+	cfg := torrent.DefaultConfig()
 	verbose := flag.Bool("v", false, "Show Verbose Peer Debug Output!")
+	port := flag.Uint("port", uint(cfg.ListenPort), "Local Port We Listen On")
+	announcePort := flag.Uint("announce-port", 0, "Port Reported To Trackers If It Differs From -port (e.g. NAT Mapping)")
+	flag.DurationVar(&cfg.ConnectTimeout, "connect-timeout", cfg.ConnectTimeout, "Timeout For Dialing A Peer")
+	flag.DurationVar(&cfg.HandshakeTimeout, "handshake-timeout", cfg.HandshakeTimeout, "Timeout For Completing The Peer Handshake")
+	flag.DurationVar(&cfg.UnchokeTimeout, "unchoke-timeout", cfg.UnchokeTimeout, "Drop Peers That Do Not Unchoke Us Within This Time")
+	flag.DurationVar(&cfg.PieceIdleTimeout, "idle-timeout", cfg.PieceIdleTimeout, "Drop A Peer That Sends Nothing For This Long Mid Piece")
+	flag.DurationVar(&cfg.MaxBackoff, "max-backoff", cfg.MaxBackoff, "Upper Bound On The Wait Between Peer Reconnects")
+	flag.DurationVar(&cfg.StallTimeout, "stall-timeout", cfg.StallTimeout, "Log Diagnostics When No Piece Completes For This Long (0 = Off)")
+	flag.BoolVar(&cfg.AbortOnStall, "abort-on-stall", cfg.AbortOnStall, "Give Up Instead Of Waiting When The Download Stalls")
+	flag.IntVar(&cfg.DialsPerSecond, "dial-rate", cfg.DialsPerSecond, "New Peer Connections Opened Per Second (0 = No Limit)")
+	flag.IntVar(&cfg.MaxPeers, "max-peers", cfg.MaxPeers, "Connect To At Most This Many Peers At Once (0 = No Limit)")
+	flag.IntVar(&cfg.MaxActivePieces, "max-active-pieces", cfg.MaxActivePieces, "Pieces Downloaded At Once Across All Peers, Bounds Memory (0 = No Limit)")
+	flag.IntVar(&cfg.BlockSize, "block-size", cfg.BlockSize, "Bytes Asked For Per Request, A Power Of Two From 1024 To 16384 (0 = 16384)")
+	flag.IntVar(&cfg.VerifyWorkers, "verify-workers", cfg.VerifyWorkers, "Goroutines Checking Piece Hashes In Parallel")
+	flag.IntVar(&cfg.MaxReconnectAttempts, "max-reconnects", cfg.MaxReconnectAttempts, "Abandon A Peer After This Many Failed Connects (0 = Never)")
+	flag.BoolVar(&cfg.ParallelAnnounce, "parallel-announce", cfg.ParallelAnnounce, "Announce To Every Tracker Of A Tier At Once And Merge Their Peers")
+	flag.DurationVar(&cfg.AnnounceTimeout, "announce-timeout", cfg.AnnounceTimeout, "Give Up On A Tracker That Takes Longer Than This To Answer")
+	flag.BoolVar(&cfg.NoCompact, "no-compact", cfg.NoCompact, "Ask The Tracker For Dictionary Peers (compact=0) When Its Compact List Is Broken")
+	announceIPv6 := flag.String("announce-ipv6", "", "Our IPv6 Address To Report To Trackers")
+	bindAddr := flag.String("bind", "", "Local IP Address To Send All Torrent Traffic From")
+	syncMode := flag.String("sync", "close", "When To fsync Written Pieces (close, piece or periodic)")
+	flag.DurationVar(&cfg.SyncInterval, "sync-interval", cfg.SyncInterval, "Time Between fsyncs In periodic Sync Mode")
+	flag.BoolVar(&cfg.SequentialDownload, "sequential", cfg.SequentialDownload, "Download Pieces In Order So Media Can Be Played Early")
+	flag.StringVar(&cfg.StatsAddr, "stats", cfg.StatsAddr, "Serve Download Stats As JSON On This Address (e.g. 127.0.0.1:9090)")
+	serveAddr := flag.String("serve", "", "Serve The Download Over HTTP On This Address While It Runs (e.g. :8080)")
+	blocklistPath := flag.String("blocklist", "", "Never Connect To Peers Listed In This .dat, .p2p Or CIDR File")
+	trackerCA := flag.String("tracker-ca", "", "PEM File With Extra CA Certificates To Trust For HTTPS Trackers")
+	outputDir := flag.String("o", ".", "Directory The Torrent Is Saved Into")
+	coverage := flag.Bool("coverage", false, "Only Ask The Tracker's Peers Which Pieces They Have And Print How Much Is Obtainable")
+	resumePath := flag.String("resume", "", "Fast Resume File To Load On Start And Save On Exit")
+	recheck := flag.Bool("recheck", false, "Verify Every Piece Of An Existing Download Against The Torrent And Exit")
+	proxyURL := flag.String("proxy", "", "Route Peers And Trackers Through A Proxy (socks5://host:port or http://host:port)")
+	flag.BoolVar(&cfg.HashFiles, "hash-files", cfg.HashFiles, "Print The SHA-256 Of Every File Once Downloaded (sha256sum Format)")
+	manifestPath := flag.String("manifest", "", "sha256sum Style File Listing Hashes The Downloaded Files Must Match")
+	flag.BoolVar(&cfg.SkipHashCheck, "skip-hash-check", false, "Do Not Verify Piece Hashes (Debugging Only, Dangerous)")
 	flag.Parse()
 
 	torrent.SetVerbose(*verbose)
+	if *port > 65535 || *announcePort > 65535 {
+		log.Fatal("Ports Must Be Between 0 And 65535")
+	}
+	cfg.ListenPort = uint16(*port)
+	cfg.AnnouncePort = uint16(*announcePort)
+	if *bindAddr != "" {
+		cfg.LocalAddr = net.ParseIP(*bindAddr)
+		if cfg.LocalAddr == nil {
+			log.Fatalf("Invalid Bind Address %s", *bindAddr)
+		}
+	}
+	mode, err := torrent.ParseSyncMode(*syncMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Sync = mode
+	if *announceIPv6 != "" {
+		cfg.AnnounceIPv6 = net.ParseIP(*announceIPv6)
+		if cfg.AnnounceIPv6 == nil || cfg.AnnounceIPv6.To4() != nil {
+			log.Fatalf("Invalid IPv6 Address %s", *announceIPv6)
+		}
+	}
+	if *blocklistPath != "" {
+		cfg.Blocklist, err = ipfilter.Load(*blocklistPath)
+		if err != nil {
+			log.Fatalf("Could Not Load Blocklist %s", err)
+		}
+	}
+	if *trackerCA != "" {
+		pem, err := os.ReadFile(*trackerCA)
+		if err != nil {
+			log.Fatalf("Could Not Read Tracker CA %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No Certificates Found In %s", *trackerCA)
+		}
+		cfg.TrackerTLS = &tls.Config{RootCAs: pool}
+	}
+	if *manifestPath != "" {
+		cfg.FileManifest, err = loadManifest(*manifestPath)
+		if err != nil {
+			log.Fatalf("Could Not Load Manifest %s", err)
+		}
+	}
+	if cfg.HashFiles {
+		cfg.OnComplete = printFileHashes
+	}
+	if *proxyURL != "" {
+		u, err := url.Parse(*proxyURL)
+		if err != nil {
+			log.Fatalf("Invalid Proxy URL %s", err)
+		}
+		cfg.Proxy = u
+	}
 	var inputStream io.Reader
 
 	args := flag.Args()
@@ -52,24 +178,183 @@ func main() {
 		panic(err)
 	}
 
+	if *recheck {
+		runRecheck(&torrentData, cfg, *outputDir)
+		return
+	}
+	// Only a resumed download may pick up files under their final name, loadResume checks them first
+	cfg.ReuseExisting = *resumePath != ""
+
+	cfg.OnAnnounce = func(info torrent.TrackerInfo) {
+		fmt.Printf("Tracker Reports %d Seeders And %d Leechers\n", info.Seeders, info.Leechers)
+	}
+
 	peerID := torrent.GeneratePeerID()
-	peers, err := torrent.RequestPeers(&torrentData, peerID, port)
+	t := torrentData.ToTorrent(nil, peerID)
+	t.Config = cfg
+	fmt.Printf("Private %t, Peer Sources %+v\n", t.Private, t.Discovery())
+
+	if !torrentData.HasTrackers() && len(torrentData.HTTPSeeds) == 0 {
+		log.Fatalf("%s Is Trackerless With %d DHT Nodes, DHT Is Not Supported Yet", t.Name, len(torrentData.Nodes))
+	}
+
+	if *coverage {
+		runCoverage(t, &torrentData, cfg)
+		return
+	}
+
+	storage, err := torrent.NewStorage(*outputDir, t)
+	if errors.Is(err, torrent.ErrPathConflict) {
+		log.Fatalf("%v, choose another output directory with -o or pass -resume to continue a download saved there", err)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("Number Of Peers %d\n", len(peers))
-	t := torrentData.ToTorrent(peers, peerID)
+	if *resumePath != "" {
+		loadResume(t, storage, *resumePath)
+		done, total := t.Progress()
+		if done == total {
+			// Nothing to fetch, DownloadTo still runs the file hashes and the manifest check
+			if err := t.DownloadTo(storage); err != nil {
+				storage.Close()
+				log.Fatal(err)
+			}
+			finish(t, storage)
+			return
+		}
+		saveResumeOnInterrupt(t, storage, *resumePath)
+	}
+
+	if torrentData.HasTrackers() {
+		peers, err := torrent.RequestPeersAll(&torrentData, peerID, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Number Of Peers %d\n", len(peers))
+		t.AddPeers(peers)
+	}
 
-	data, err := t.Download()
+	if *serveAddr != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*serveAddr, torrent.NewStreamHandler(t, storage)))
+		}()
+	}
+
+	bar := newProgressBar(os.Stdout)
+	t.Config.OnProgress = bar.update
+	err = t.DownloadTo(storage)
+	bar.finish()
+	if *resumePath != "" {
+		saveResume(t, storage, *resumePath)
+	}
 	if err != nil {
+		storage.Close()
 		log.Fatal(err)
 	}
+	finish(t, storage)
+}
+
+// Reads "<sha256>  <path>" lines as written by sha256sum or -hash-files
+func loadManifest(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, file, ok := strings.Cut(line, " ")
+		if !ok || len(hash) != 64 {
+			return nil, fmt.Errorf("line %d of %s is not \"<sha256>  <path>\"", i+1, path)
+		}
+		// sha256sum marks binary mode with a '*' in front of the name
+		manifest[strings.TrimPrefix(strings.TrimSpace(file), "*")] = hash
+	}
+	return manifest, nil
+}
 
-	err = saveToOs(t.Name, data)
+func printFileHashes(s torrent.Stats) {
+	paths := make([]string, 0, len(s.FileHashes))
+	for path := range s.FileHashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Printf("%s  %s\n", s.FileHashes[path], path)
+	}
+}
+
+func runCoverage(t *torrent.Torrent, torrentData *torrent.TorrentFile, cfg torrent.Config) {
+	peers, err := torrent.RequestPeersAll(torrentData, t.PeerID, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := torrent.SwarmCoverage(t, peers)
 	if err != nil {
 		log.Fatal(err)
 	}
+	addrs := make([]string, 0, len(c.PeerPieces))
+	for addr := range c.PeerPieces {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		fmt.Printf("%-22s %d/%d Pieces\n", addr, c.PeerPieces[addr], c.PiecesTotal)
+	}
+	percent := float64(c.PiecesAvailable) / float64(max(c.PiecesTotal, 1)) * 100
+	fmt.Printf("%d Of %d Peers Reached, %d/%d Pieces (%.2f%%) Obtainable, Completable: %t\n",
+		c.PeersReached, len(peers), c.PiecesAvailable, c.PiecesTotal, percent, c.Complete())
+}
 
+func finish(t *torrent.Torrent, storage *torrent.Storage) {
+	err := storage.Finish()
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("The Torrent Has Been Saved To Your Computer --> ", t.Name)
 }
+
+// Trusts the resume file when it still matches the files, otherwise hashes whatever is on disk
+func loadResume(t *torrent.Torrent, storage *torrent.Storage, path string) {
+	err := t.LoadResume(path, storage)
+	if err == nil {
+		done, total := t.Progress()
+		fmt.Printf("Resumed %s: %d Of %d Pieces Already Done\n", t.Name, done, total)
+		return
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Could Not Use Resume File, Rechecking: %v", err)
+	} else if storage.Fresh() {
+		return
+	}
+	passed, _, err := t.Recheck(storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if passed > 0 {
+		fmt.Printf("Recheck Found %d Pieces Already Done\n", passed)
+	}
+}
+
+func saveResume(t *torrent.Torrent, storage *torrent.Storage, path string) {
+	err := t.SaveResume(path, storage)
+	if err != nil {
+		log.Printf("Could Not Save Resume File: %v", err)
+	}
+}
+
+// Ctrl-C still leaves a resume file behind so the next run starts where this one stopped
+func saveResumeOnInterrupt(t *torrent.Torrent, storage *torrent.Storage, path string) {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		saveResume(t, storage, path)
+		storage.Close()
+		os.Exit(1)
+	}()
+}
@@ -18,6 +18,7 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+	MsgExtended      messageID = 20
 )
 
 type Message struct {
@@ -25,16 +26,32 @@ type Message struct {
 	Payload []byte
 }
 
+func (m *Message) Len() int {
+	if m == nil {
+		return 4
+	}
+	return 5 + len(m.Payload)
+}
+
 func (m *Message) Serialize() []byte {
+	buffer := make([]byte, m.Len())
+	m.SerializeTo(buffer)
+	return buffer
+}
+
+func (m *Message) SerializeTo(buf []byte) (int, error) {
+	if len(buf) < m.Len() {
+		return 0, io.ErrShortBuffer
+	}
 	if m == nil {
-		return make([]byte, 4)
+		clear(buf[0:4])
+		return 4, nil
 	}
 	length := uint32(len(m.Payload) + 1)
-	buffer := make([]byte, 4+length)
-	binary.BigEndian.PutUint32(buffer[0:4], length)
-	buffer[4] = byte(m.ID)
-	copy(buffer[5:], m.Payload)
-	return buffer
+	binary.BigEndian.PutUint32(buf[0:4], length)
+	buf[4] = byte(m.ID)
+	copy(buf[5:], m.Payload)
+	return m.Len(), nil
 }
 
 func ReadMessage(r io.Reader) (*Message, error) {
@@ -61,36 +78,29 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	return &m, nil
 }
 
-func ParsePieceMessage(index int, buf []byte, msg *Message) (int, error) {
-	if msg.ID != MsgPiece {
-		return 0, fmt.Errorf("Expected PIECE message got %x", msg.ID)
-	}
-	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("Expected Payload greater than 8 got %d", len(msg.Payload))
-	}
-	parsedIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
-	if parsedIndex != index {
-		return 0, fmt.Errorf("Got The Wrong Piece Here Expected %d", index)
-	}
-	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-	if begin >= len(buf) {
-		return 0, fmt.Errorf("Begin is too HIGH")
+// Index of a Have message, false for any other message or a malformed payload
+func (m *Message) AsHave() (int, bool) {
+	if m == nil || m.ID != MsgHave || len(m.Payload) != 4 {
+		return 0, false
 	}
-	data := msg.Payload[8:]
-	if len(data)+begin > len(buf) {
-		return 0, fmt.Errorf("Data is too long for the offset Begin %d %d", len(data), begin)
+	return int(binary.BigEndian.Uint32(m.Payload)), true
+}
+
+// Fields of a Piece message, data points into the payload and is not copied.
+// False for any other message or one too short to hold index and begin.
+func (m *Message) AsPiece() (index, begin int, data []byte, ok bool) {
+	if m == nil || m.ID != MsgPiece || len(m.Payload) < 8 {
+		return 0, 0, nil, false
 	}
-	copy(buf[begin:], data)
-	return len(data), nil
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	return index, begin, m.Payload[8:], true
 }
 
 func ParseHaveMessage(msg *Message) (int, error) {
-	if msg.ID != MsgHave {
-		return 0, fmt.Errorf("Expected HAVE , got ID %d", msg.ID)
-	}
-	if len(msg.Payload) != 4 {
-		return 0, fmt.Errorf("Expected Length got %d", msg.Payload)
+	index, ok := msg.AsHave()
+	if !ok {
+		return 0, fmt.Errorf("Expected HAVE with a 4 byte payload")
 	}
-	index := int(binary.BigEndian.Uint32(msg.Payload))
 	return index, nil
 }
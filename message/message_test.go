@@ -0,0 +1,65 @@
+package message
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func requestMessage(index int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[8:12], 16384)
+	return &Message{ID: MsgRequest, Payload: payload}
+}
+
+// The request send loop before SerializeTo, a fresh buffer per message
+func BenchmarkSerialize(b *testing.B) {
+	msg := requestMessage(1)
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = msg.Serialize()
+	}
+}
+
+// The request send loop as Client.send does it, one scratch buffer per connection
+func BenchmarkSerializeTo(b *testing.B) {
+	msg := requestMessage(1)
+	scratch := make([]byte, msg.Len())
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := msg.SerializeTo(scratch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func pieceMessage(index, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+func TestAsPiece(t *testing.T) {
+	index, begin, data, ok := pieceMessage(2, 16384, []byte{1, 2, 3}).AsPiece()
+	if !ok || index != 2 || begin != 16384 || string(data) != "\x01\x02\x03" {
+		t.Errorf("got %d, %d, %v, %t", index, begin, data, ok)
+	}
+	if _, _, data, ok := pieceMessage(2, 0, nil).AsPiece(); !ok || len(data) != 0 {
+		t.Errorf("an empty block gave %v, %t", data, ok)
+	}
+
+	short := pieceMessage(2, 0, nil)
+	short.Payload = short.Payload[:7]
+	for name, msg := range map[string]*Message{
+		"nil":           nil,
+		"short payload": short,
+		"no payload":    {ID: MsgPiece},
+		"request":       requestMessage(2),
+	} {
+		if _, _, _, ok := msg.AsPiece(); ok {
+			t.Errorf("%s was taken for a piece", name)
+		}
+	}
+}
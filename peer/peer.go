@@ -2,20 +2,39 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"bitTorrent/helpers/bitfield"
+	"bitTorrent/helpers/ipfilter"
 	"bitTorrent/message"
 )
 
 type Peer struct {
 	IP   net.IP
 	port uint16
+	// Peer id a tracker listed with a dictionary peer, empty when unknown
+	ID string
+}
+
+// Stores IPv4 addresses in their 4 byte form so a peer and its 4-in-6 twin compare equal
+func NewPeer(ip net.IP, port uint16) Peer {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return Peer{IP: ip, port: port}
+}
+
+func (p Peer) Port() uint16 {
+	return p.port
 }
 
 func (p Peer) String() string {
@@ -26,27 +45,75 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	const peerSize = 6
 	numPeers := len(peersBin) / peerSize
 	if len(peersBin)%peerSize != 0 {
-		err := fmt.Errorf("MalInformation recieved")
+		err := fmt.Errorf("compact peer list length %d not a multiple of %d", len(peersBin), peerSize)
 		return nil, err
 	}
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].port = binary.BigEndian.Uint16(peersBin[offset+4 : offset+6])
+		ip := make(net.IP, 4)
+		copy(ip, peersBin[offset:offset+4])
+		peers[i] = NewPeer(ip, binary.BigEndian.Uint16(peersBin[offset+4:offset+6]))
 	}
 	return peers, nil
 }
 
+// Decodes the BEP7 peers6 format, 16 byte address followed by a 2 byte port
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18
+	if len(peersBin)%peerSize != 0 {
+		return nil, fmt.Errorf("compact peer6 list length %d not a multiple of %d", len(peersBin), peerSize)
+	}
+	peers := make([]Peer, len(peersBin)/peerSize)
+	for i := range peers {
+		offset := i * peerSize
+		ip := make(net.IP, 16)
+		copy(ip, peersBin[offset:offset+16])
+		peers[i] = NewPeer(ip, binary.BigEndian.Uint16(peersBin[offset+16:offset+18]))
+	}
+	return peers, nil
+}
+
+func Marshal(peers []Peer) ([]byte, error) {
+	const peerSize = 6
+	peersBin := make([]byte, len(peers)*peerSize)
+	for i, p := range peers {
+		ip := p.IP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("peer %s is not an IPv4 address", p)
+		}
+		offset := i * peerSize
+		copy(peersBin[offset:offset+4], ip)
+		binary.BigEndian.PutUint16(peersBin[offset+4:offset+6], p.port)
+	}
+	return peersBin, nil
+}
+
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+func (h *Handshake) SupportsExtensionProtocol() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[7]&0x04 != 0
+}
+
+func (h *Handshake) SupportsDHT() bool {
+	return h.Reserved[7]&0x01 != 0
+}
+
+// The only protocol string BitTorrent v1 peers send
+const protocolString = "BitTorrent protocol"
+
 func New(infohash, peerID [20]byte) *Handshake {
 	return &Handshake{
-		Pstr:     "BitTorrent protocol",
+		Pstr:     protocolString,
 		InfoHash: infohash,
 		PeerID:   peerID,
 	}
@@ -57,27 +124,41 @@ func (h *Handshake) Serialize() []byte {
 	cursor := 1
 	buffer[0] = byte(len(h.Pstr))
 	cursor += copy(buffer[cursor:], h.Pstr)
-	cursor += copy(buffer[cursor:], make([]byte, 8))
+	cursor += copy(buffer[cursor:], h.Reserved[:])
 	cursor += copy(buffer[cursor:], h.InfoHash[:])
 	cursor += copy(buffer[cursor:], h.PeerID[:])
 	return buffer
 }
 
+var (
+	ErrHandshakeTruncated = errors.New("handshake truncated")
+	ErrInvalidPstrlen     = errors.New("invalid handshake pstrlen")
+	ErrInfoHashMismatch   = errors.New("infohash mismatch")
+	ErrBadBitfield        = errors.New("bad bitfield")
+	ErrBlocked            = errors.New("peer address is blocked")
+	ErrPeerDisconnected   = errors.New("peer closed the connection")
+)
+
 func ReadHandShake(r io.Reader) (*Handshake, error) {
 	lengthBuffer := make([]byte, 1)
 	_, err := io.ReadFull(r, lengthBuffer)
 	if err != nil {
-		return nil, err
+		return nil, wrapHandshakeErr(err)
 	}
 	pstrlen := int(lengthBuffer[0])
+	// Anything else is not a BitTorrent peer, no point reading up to 255 bytes of junk
+	if pstrlen != len(protocolString) {
+		return nil, fmt.Errorf("%w: got %d, expected %d", ErrInvalidPstrlen, pstrlen, len(protocolString))
+	}
 	handshakeBuffer := make([]byte, pstrlen+48)
 	_, err = io.ReadFull(r, handshakeBuffer)
 	if err != nil {
-		return nil, err
+		return nil, wrapHandshakeErr(err)
 	}
 	h := Handshake{}
 	h.Pstr = string(handshakeBuffer[0:pstrlen])
 	cursor := pstrlen
+	copy(h.Reserved[:], handshakeBuffer[cursor:cursor+8])
 	cursor += 8
 	copy(h.InfoHash[:], handshakeBuffer[cursor:cursor+20])
 	cursor += 20
@@ -85,6 +166,14 @@ func ReadHandShake(r io.Reader) (*Handshake, error) {
 	return &h, nil
 }
 
+// A peer closing the stream mid handshake shows up as EOF or ErrUnexpectedEOF
+func wrapHandshakeErr(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrHandshakeTruncated, err)
+	}
+	return err
+}
+
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
@@ -92,10 +181,38 @@ type Client struct {
 	peer     Peer
 	peerID   [20]byte
 	infoHash [20]byte
+	scratch  []byte
+	remote   *Handshake
+	// Extension name to the id the peer wants, from its BEP10 extended handshake
+	extensions map[string]uint8
+	traffic    *countingConn
+	// The torrent broadcasts Haves from outside the worker so sends have to take turns
+	sendMu sync.Mutex
+
+	DialDuration      time.Duration
+	HandshakeDuration time.Duration
+}
+
+// Reuses the per connection scratch buffer so the send path does not allocate
+func (c *Client) send(msg *message.Message) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if cap(c.scratch) < msg.Len() {
+		c.scratch = make([]byte, msg.Len())
+	}
+	n, err := msg.SerializeTo(c.scratch[:cap(c.scratch)])
+	if err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(c.scratch[:n])
+	return err
 }
 
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.ReadMessage(c.Conn)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return nil, fmt.Errorf("%w: %w", ErrPeerDisconnected, err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -103,48 +220,104 @@ func (c *Client) Read() (*message.Message, error) {
 }
 
 func (c *Client) SendRequest(index, begin, length int) error {
-	req := formatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.send(formatRequest(index, begin, length))
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	return c.send(formatCancel(index, begin, length))
 }
 
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.send(&message.Message{ID: message.MsgInterested})
 }
 
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.send(&message.Message{ID: message.MsgNotInterested})
 }
 
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	if err != nil {
-		return err
+	return c.send(&message.Message{ID: message.MsgUnchoke})
+}
+
+func (c *Client) SendExtended(extendedID uint8, payload []byte) error {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extendedID
+	copy(buf[1:], payload)
+	return c.send(&message.Message{ID: message.MsgExtended, Payload: buf})
+}
+
+func (c *Client) SupportsExtensionProtocol() bool {
+	return c.remote != nil && c.remote.SupportsExtensionProtocol()
+}
+
+// Bytes read from the peer so far, handshake and message framing included
+func (c *Client) BytesDownloaded() int64 {
+	if c.traffic == nil {
+		return 0
 	}
-	return nil
+	return c.traffic.own.Downloaded.Load()
 }
 
-func (c *Client) SendHave(index int) error {
-	msg := formatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	if err != nil {
-		return err
+// Bytes written to the peer so far, handshake and message framing included
+func (c *Client) BytesUploaded() int64 {
+	if c.traffic == nil {
+		return 0
+	}
+	return c.traffic.own.Uploaded.Load()
+}
+
+// The peer id from the remote handshake
+func (c *Client) PeerID() [20]byte {
+	if c.remote == nil {
+		return [20]byte{}
 	}
-	return nil
+	return c.remote.PeerID
+}
+
+func (c *Client) SupportsFast() bool {
+	return c.remote != nil && c.remote.SupportsFast()
+}
+
+func (c *Client) SupportsDHT() bool {
+	return c.remote != nil && c.remote.SupportsDHT()
+}
+
+// The reserved bytes the peer sent in its handshake
+func (c *Client) Reserved() [8]byte {
+	if c.remote == nil {
+		return [8]byte{}
+	}
+	return c.remote.Reserved
+}
+
+// Remembers the "m" dictionary of the peer's extended handshake. A later handshake
+// only updates what it lists and an id of 0 disables that extension (BEP10).
+func (c *Client) SetExtensions(m map[string]int) {
+	if c.extensions == nil {
+		c.extensions = map[string]uint8{}
+	}
+	for name, id := range m {
+		if id <= 0 || id > 255 {
+			delete(c.extensions, name)
+			continue
+		}
+		c.extensions[name] = uint8(id)
+	}
+}
+
+// The id to send extension messages for name with, false if the peer does not support it
+func (c *Client) ExtensionID(name string) (uint8, bool) {
+	id, ok := c.extensions[name]
+	return id, ok
+}
+
+// Must be the first message after the handshake, spare bits past the last piece have to be zero
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	return c.send(&message.Message{ID: message.MsgBitField, Payload: bf})
+}
+
+func (c *Client) SendHave(index int) error {
+	return c.send(formatHave(index))
 }
 
 func formatHave(index int) *message.Message {
@@ -161,11 +334,18 @@ func formatRequest(index, begin, length int) *message.Message {
 	return &message.Message{ID: message.MsgRequest, Payload: payload}
 }
 
-func completeHandshake(conn net.Conn, peerid [20]byte, infohash [20]byte) (*Handshake, error) {
-	conn.SetDeadline(time.Now().Add(3 * time.Second))
+func formatCancel(index, begin, length int) *message.Message {
+	msg := formatRequest(index, begin, length)
+	msg.ID = message.MsgCancel
+	return msg
+}
+
+func completeHandshake(conn net.Conn, peerid [20]byte, infohash [20]byte, opts Options) (*Handshake, error) {
+	conn.SetDeadline(time.Now().Add(opts.HandshakeTimeout))
 	defer conn.SetDeadline(time.Time{})
 
 	request := New(infohash, peerid)
+	request.Reserved = opts.Reserved
 	_, err := conn.Write(request.Serialize())
 	if err != nil {
 		return nil, err
@@ -177,7 +357,7 @@ func completeHandshake(conn net.Conn, peerid [20]byte, infohash [20]byte) (*Hand
 	}
 
 	if !bytes.Equal(response.InfoHash[:], infohash[:]) {
-		return nil, fmt.Errorf("expected infohash %x but got %x", response.InfoHash, infohash)
+		return nil, fmt.Errorf("%w: expected infohash %x but got %x", ErrInfoHashMismatch, infohash, response.InfoHash)
 	}
 
 	return response, nil
@@ -199,22 +379,81 @@ func recieveBitField(conn net.Conn) (bitfield.Bitfield, error) {
 	return msg.Payload, nil
 }
 
-func NewClient(peer Peer, peerid [20]byte, infohash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type Options struct {
+	// Cancels dialing and the handshake in NewClient, nil means never
+	Context          context.Context
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	// Used for every peer connection when set, e.g. to go through a proxy
+	Dialer Dialer
+	// Capability bits advertised in our handshake
+	Reserved [8]byte
+	// Peers in these ranges are never dialed
+	Blocklist *ipfilter.Filter
+	// Every connection made with these Options also adds its bytes here
+	Traffic *Traffic
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ConnectTimeout:   3 * time.Second,
+		HandshakeTimeout: 3 * time.Second,
+	}
+}
+
+func dial(address string, opts Options) (net.Conn, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ConnectTimeout)
+		defer cancel()
+	}
+	var dialer Dialer = &net.Dialer{}
+	if opts.Dialer != nil {
+		dialer = opts.Dialer
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+func NewClient(peer Peer, peerid [20]byte, infohash [20]byte, opts Options) (*Client, error) {
+	if opts.Blocklist.Blocked(peer.IP) {
+		return nil, fmt.Errorf("%w: %s", ErrBlocked, peer)
+	}
+
+	start := time.Now()
+	raw, err := dial(peer.String(), opts)
 	if err != nil {
 		return nil, err
 	}
+	counting := &countingConn{Conn: raw, shared: opts.Traffic}
+	var conn net.Conn = counting
+	dialDuration := time.Since(start)
+
+	// Closing the conn is the only way to break out of a blocked handshake read
+	if opts.Context != nil {
+		stop := context.AfterFunc(opts.Context, func() { conn.Close() })
+		defer stop()
+	}
 
-	_, err = completeHandshake(conn, peerid, infohash)
+	start = time.Now()
+	remote, err := completeHandshake(conn, peerid, infohash, opts)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	handshakeDuration := time.Since(start)
 
 	bf, err := recieveBitField(conn)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrBadBitfield, err)
 	}
 
 	return &Client{
@@ -224,5 +463,10 @@ func NewClient(peer Peer, peerid [20]byte, infohash [20]byte) (*Client, error) {
 		peer:     peer,
 		peerID:   peerid,
 		infoHash: infohash,
+		remote:   remote,
+		traffic:  counting,
+
+		DialDuration:      dialDuration,
+		HandshakeDuration: handshakeDuration,
 	}, nil
 }
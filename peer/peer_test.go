@@ -0,0 +1,119 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"bitTorrent/message"
+)
+
+func TestReadHandShake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	peerID := [20]byte{4, 5, 6}
+	valid := New(infoHash, peerID).Serialize()
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"valid", valid, nil},
+		{"zero pstrlen", append([]byte{0}, valid[1:]...), ErrInvalidPstrlen},
+		{"pstrlen too long", append([]byte{255}, valid[1:]...), ErrInvalidPstrlen},
+		{"pstrlen too short", append([]byte{18}, valid[1:]...), ErrInvalidPstrlen},
+		{"empty", nil, ErrHandshakeTruncated},
+		{"truncated", valid[:30], ErrHandshakeTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ReadHandShake(bytes.NewReader(tt.data))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Pstr != protocolString || h.InfoHash != infoHash || h.PeerID != peerID {
+				t.Errorf("got %+v", h)
+			}
+		})
+	}
+}
+
+func TestFormatCancel(t *testing.T) {
+	request := formatRequest(3, 16384, 1024)
+	cancel := formatCancel(3, 16384, 1024)
+	if cancel.ID != message.MsgCancel {
+		t.Fatalf("got id %d, want %d", cancel.ID, message.MsgCancel)
+	}
+	want := []byte{0, 0, 0, 3, 0, 0, 0x40, 0, 0, 0, 0x04, 0}
+	if !bytes.Equal(cancel.Payload, want) {
+		t.Errorf("payload %x, want %x", cancel.Payload, want)
+	}
+	if !bytes.Equal(cancel.Payload, request.Payload) {
+		t.Errorf("cancel payload %x differs from request payload %x", cancel.Payload, request.Payload)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	peers := []Peer{
+		NewPeer(net.IP{127, 0, 0, 1}, 6881),
+		NewPeer(net.IP{10, 1, 2, 3}, 65535),
+		NewPeer(net.ParseIP("192.168.0.1"), 1),
+	}
+	data, err := Marshal(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 6*len(peers) {
+		t.Fatalf("got %d bytes, want %d", len(data), 6*len(peers))
+	}
+	got, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(peers) {
+		t.Fatalf("got %d peers, want %d", len(got), len(peers))
+	}
+	for i := range peers {
+		if got[i].String() != peers[i].String() {
+			t.Errorf("peer %d is %s, want %s", i, got[i], peers[i])
+		}
+	}
+
+	if _, err := Marshal([]Peer{NewPeer(net.ParseIP("::1"), 6881)}); err == nil {
+		t.Error("expected an error for an IPv6 peer")
+	}
+}
+
+func TestMappedIPv4IsTheSamePeer(t *testing.T) {
+	v4, err := Unmarshal([]byte{1, 2, 3, 4, 0x1a, 0xe1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := append(make([]byte, 10), 0xff, 0xff, 1, 2, 3, 4, 0x1a, 0xe1)
+	v6, err := Unmarshal6(mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := NewPeer(net.ParseIP("1.2.3.4"), 6881)
+
+	seen := map[string]bool{}
+	for _, p := range []Peer{v4[0], v6[0], parsed} {
+		if len(p.IP) != net.IPv4len {
+			t.Errorf("%s is stored as a %d byte IP", p, len(p.IP))
+		}
+		seen[p.String()] = true
+	}
+	if len(seen) != 1 {
+		t.Errorf("got %d distinct peers, want 1: %v", len(seen), seen)
+	}
+	if !v4[0].IP.Equal(v6[0].IP) || !bytes.Equal(v4[0].IP, v6[0].IP) {
+		t.Errorf("%v and %v differ", []byte(v4[0].IP), []byte(v6[0].IP))
+	}
+}
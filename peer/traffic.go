@@ -0,0 +1,37 @@
+package peer
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Bytes that crossed the wire, protocol overhead included. Safe to read from any goroutine.
+type Traffic struct {
+	Downloaded atomic.Int64
+	Uploaded   atomic.Int64
+}
+
+// Counts into the connection's own Traffic and, when set, one shared by every connection
+type countingConn struct {
+	net.Conn
+	own    Traffic
+	shared *Traffic
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.own.Downloaded.Add(int64(n))
+	if c.shared != nil {
+		c.shared.Downloaded.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.own.Uploaded.Add(int64(n))
+	if c.shared != nil {
+		c.shared.Uploaded.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"bitTorrent/torrent"
+)
+
+const barWidth = 30
+
+// Draws one line that is rewritten in place on a terminal, when stdout is piped
+// it prints a plain line every logInterval instead
+type progressBar struct {
+	out         io.Writer
+	tty         bool
+	logInterval time.Duration
+
+	lastBytes  int
+	lastTime   time.Time
+	lastLogged time.Time
+	speed      float64 // bytes per second, smoothed
+}
+
+func newProgressBar(out *os.File) *progressBar {
+	tty := false
+	if info, err := out.Stat(); err == nil {
+		tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &progressBar{out: out, tty: tty, logInterval: 10 * time.Second, lastTime: time.Now()}
+}
+
+func (p *progressBar) update(s torrent.Stats) {
+	now := time.Now()
+	if elapsed := now.Sub(p.lastTime).Seconds(); elapsed > 0 {
+		current := float64(s.BytesCompleted-p.lastBytes) / elapsed
+		if p.speed == 0 {
+			p.speed = current
+		} else {
+			p.speed = 0.8*p.speed + 0.2*current
+		}
+	}
+	p.lastBytes, p.lastTime = s.BytesCompleted, now
+
+	percent := 0.0
+	if s.Length > 0 {
+		percent = float64(s.BytesCompleted) / float64(s.Length) * 100
+	}
+	eta := "--"
+	if p.speed > 0 {
+		eta = (time.Duration(float64(s.Length-s.BytesCompleted)/p.speed) * time.Second).Round(time.Second).String()
+	}
+	stats := fmt.Sprintf("%5.1f%% %s/%s %s/s ETA %s %d peers", percent,
+		formatBytes(float64(s.BytesCompleted)), formatBytes(float64(s.Length)), formatBytes(p.speed), eta, s.Metrics.PeersConnected)
+
+	if !p.tty {
+		done := s.PiecesCompleted == s.PiecesTotal
+		if done || now.Sub(p.lastLogged) >= p.logInterval {
+			fmt.Fprintln(p.out, stats)
+			p.lastLogged = now
+		}
+		return
+	}
+	filled := int(percent / 100 * barWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", barWidth-filled)
+	// Trailing spaces wipe whatever was left of a longer previous line
+	fmt.Fprintf(p.out, "\r[%s] %s   ", bar, stats)
+}
+
+func (p *progressBar) finish() {
+	if p.tty {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
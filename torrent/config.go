@@ -0,0 +1,283 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"bitTorrent/helpers/ipfilter"
+	"bitTorrent/peer"
+)
+
+type Config struct {
+	ListenPort           uint16
+	AnnouncePort         uint16 // reported to trackers instead of ListenPort when set, e.g. behind NAT
+	AnnounceIPv6         net.IP // sent as the ipv6 announce parameter so trackers can hand us out to v6 peers
+	AnnounceKey          string // random token trackers use to recognise us across announces if our IP changes
+	ConnectTimeout       time.Duration
+	HandshakeTimeout     time.Duration
+	UnchokeTimeout       time.Duration
+	PieceIdleTimeout     time.Duration
+	MaxBackoff           time.Duration
+	MaxReconnectAttempts int // 0 keeps reconnecting forever
+	MaxPiecesPerPeer     int // pieces one worker interleaves block requests across
+	MaxPeers             int // peers connected at once, the rest wait for a free slot. 0 means no limit
+	DialsPerSecond       int // new connection attempts per second across all workers, 0 means no limit
+	VerifyWorkers        int // goroutines hashing finished pieces, and pieces on disk in Recheck
+	MaxActivePieces      int // piece buffers being filled at once across all peers, 0 means no limit
+	BlockSize            int // bytes asked for per request, a power of two from MinBlockSize to BLOCKSIZE. 0 means BLOCKSIZE
+	// Runs once every piece is verified, before Download returns
+	OnComplete func(Stats)
+	// Runs after every verified piece and replaces the default per piece line on stdout
+	OnProgress func(Stats)
+	// Peer and tracker connections egress from this address when set
+	LocalAddr net.IP
+	// Looks up tracker and peer host names, net.DefaultResolver when nil
+	Resolver *net.Resolver
+	// How long a dual stack host gets on its first address family before the other
+	// one is tried in parallel (happy eyeballs), so a dead IPv6 route can not stall an announce
+	FallbackDelay time.Duration
+	// socks5://, socks5h:// or http:// proxy used for peers and trackers
+	Proxy *url.URL
+	// Overrides the capability bits sent in our handshake, which are otherwise built from
+	// the features in use. With the extension protocol bit (Reserved[5] 0x10) set peers
+	// also get our listen port in an extended handshake. The DHT bit is always cleared
+	// when Torrent.Discovery rules DHT out
+	Reserved [8]byte
+	// Called with our address as a peer sees it, from the yourip key of its extended handshake
+	OnExternalIP func(net.IP)
+	// Lets NewStorage open files already under their final name, e.g. a finished download
+	// being resumed or rechecked. They are never truncated and can not be written until
+	// LoadResume or Recheck has checked them. Without it such a file is an ErrPathConflict
+	ReuseExisting bool
+	// When Storage fsyncs written pieces, SyncInterval only applies to SyncPeriodic
+	Sync         SyncMode
+	SyncInterval time.Duration
+	// Hands out pieces in ascending index order so a prefix of the file is usable early
+	SequentialDownload bool
+	// Custom piece order, overrides SequentialDownload. RarestFirst when nil
+	PieceStrategy PieceStrategy
+	// Called after every successful announce with the tracker's view of the swarm
+	OnAnnounce func(TrackerInfo)
+	// Swarm observers, the connect and disconnect hooks are called from worker goroutines.
+	// OnPeerDiscovered runs once per distinct peer, for those in Torrent.Peers when the download
+	// starts and for every new one AddPeers gets, whichever source it came from
+	OnPeerDiscovered   func(peer.Peer)
+	OnPeerConnected    func(peer.Peer)
+	OnPeerDisconnected func(peer.Peer)
+	// Peers inside these ranges are logged and dropped instead of dialed
+	Blocklist *ipfilter.Filter
+	// Custom CAs, client certificates or SNI for HTTPS trackers
+	TrackerTLS *tls.Config
+	// Replaces the tracker HTTP client entirely, LocalAddr and TrackerTLS are then ignored for trackers.
+	// Can not be combined with Proxy, tracker traffic would silently bypass it
+	HTTPClient *http.Client
+	// Extra announce parameters some private trackers want, replaces ours on a clash
+	TrackerParams url.Values
+	// Asks for compact=0 dictionary peers, a workaround for trackers with broken compact lists
+	NoCompact bool
+	// Warns when a peer's handshake carries a different peer id than its tracker entry, only dictionary peers have one
+	CheckPeerID bool
+	// Gives up on a tracker that has not answered an announce within this, 0 waits forever
+	AnnounceTimeout time.Duration
+	// RequestPeersAll asks every tracker of a tier at once instead of one after another
+	ParallelAnnounce bool
+	// Peer sources beyond the tracker, always off for private torrents, see Torrent.Discovery
+	DHT bool
+	PEX bool
+	LSD bool
+	// Logs peers and missing pieces when nothing completes for this long, 0 turns it off.
+	// With AbortOnStall the download also returns ErrStalled.
+	StallTimeout time.Duration
+	AbortOnStall bool
+	// Hashes every file with SHA-256 once the download is done and hands the result to
+	// OnComplete in Stats.FileHashes. DownloadTo's writer has to be an io.ReaderAt
+	HashFiles bool
+	// Expected hex SHA-256 by path as in Stats.FileHashes, a mismatch fails the download
+	// with ErrManifestMismatch. Implies HashFiles
+	FileManifest map[string]string
+	// Serves Stats as JSON on this address while DownloadTo runs, e.g. "127.0.0.1:9090". Off when empty
+	StatsAddr string
+	// DANGEROUS, writes pieces without checking their SHA-1. Only for debugging transfer vs hashing problems
+	SkipHashCheck bool
+}
+
+func DefaultConfig() Config {
+	opts := peer.DefaultOptions()
+	return Config{
+		ListenPort:           6881,
+		AnnounceKey:          newAnnounceKey(),
+		ConnectTimeout:       opts.ConnectTimeout,
+		HandshakeTimeout:     opts.HandshakeTimeout,
+		UnchokeTimeout:       15 * time.Second,
+		PieceIdleTimeout:     30 * time.Second,
+		MaxBackoff:           30 * time.Second,
+		MaxReconnectAttempts: 8,
+		MaxPiecesPerPeer:     4,
+		DialsPerSecond:       20,
+		VerifyWorkers:        min(runtime.NumCPU(), 4),
+		Sync:                 SyncOnClose,
+		SyncInterval:         10 * time.Second,
+		FallbackDelay:        100 * time.Millisecond,
+		StallTimeout:         2 * time.Minute,
+		AnnounceTimeout:      15 * time.Second,
+	}
+}
+
+// Smallest block we ask for, below this the request overhead outweighs the data
+const MinBlockSize = 1024
+
+func (c Config) blockSize() int {
+	if c.BlockSize == 0 {
+		return BLOCKSIZE
+	}
+	return c.BlockSize
+}
+
+// Many peers drop the connection on requests above 16 KiB, and a block size
+// that is not a power of two leaves odd sized blocks in the middle of pieces
+func (c Config) validateBlockSize() error {
+	size := c.blockSize()
+	if size < MinBlockSize || size > BLOCKSIZE || size&(size-1) != 0 {
+		return fmt.Errorf("block size %d must be a power of two from %d to %d", size, MinBlockSize, BLOCKSIZE)
+	}
+	return nil
+}
+
+// Every timeout ends up as a deadline, at zero or below each read or dial fails straight
+// away and every peer is dropped as soon as it connects. A MaxBackoff of zero would
+// redial a refusing peer or web seed in a tight loop until it runs out of attempts
+func (c Config) validateTimeouts() error {
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ConnectTimeout", c.ConnectTimeout},
+		{"HandshakeTimeout", c.HandshakeTimeout},
+		{"UnchokeTimeout", c.UnchokeTimeout},
+		{"PieceIdleTimeout", c.PieceIdleTimeout},
+		{"MaxBackoff", c.MaxBackoff},
+	} {
+		if timeout.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", timeout.name, timeout.value)
+		}
+	}
+	return nil
+}
+
+func newAnnounceKey() string {
+	var key [4]byte
+	rand.Read(key[:])
+	return hex.EncodeToString(key[:])
+}
+
+func (c Config) strategy() PieceStrategy {
+	switch {
+	case c.PieceStrategy != nil:
+		return c.PieceStrategy
+	case c.SequentialDownload:
+		return Sequential{}
+	}
+	return RarestFirst{}
+}
+
+func (c Config) announcePort() uint16 {
+	if c.AnnouncePort != 0 {
+		return c.AnnouncePort
+	}
+	return c.ListenPort
+}
+
+// A supplied HTTPClient does not know about Proxy, announcing through it would leak
+// our address to trackers while peers still go through the proxy
+func (c Config) checkProxy() error {
+	if c.HTTPClient != nil && c.Proxy != nil {
+		return fmt.Errorf("proxy %s can not be used with a custom HTTPClient, set the proxy on its transport instead", c.Proxy.Redacted())
+	}
+	return nil
+}
+
+func (c Config) clientOptions() (peer.Options, error) {
+	if err := c.checkProxy(); err != nil {
+		return peer.Options{}, err
+	}
+	dialer, err := c.peerDialer()
+	if err != nil {
+		return peer.Options{}, err
+	}
+	return peer.Options{
+		ConnectTimeout:   c.ConnectTimeout,
+		HandshakeTimeout: c.HandshakeTimeout,
+		Dialer:           dialer,
+		Reserved:         c.Reserved,
+		Blocklist:        c.Blocklist,
+	}, nil
+}
+
+func (c Config) directDialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		Resolver:      c.Resolver,
+		FallbackDelay: c.FallbackDelay,
+	}
+	if c.LocalAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: c.LocalAddr}
+	}
+	return dialer
+}
+
+func (c Config) peerDialer() (peer.Dialer, error) {
+	direct := c.directDialer()
+	if c.Proxy == nil {
+		return direct, nil
+	}
+	switch c.Proxy.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(c.Proxy, direct)
+		if err != nil {
+			return nil, err
+		}
+		contextDialer, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("proxy %s can not dial with a context", c.Proxy.Redacted())
+		}
+		return contextDialer, nil
+	case "http":
+		return &httpConnectDialer{proxy: c.Proxy, forward: direct}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", c.Proxy.Scheme)
+}
+
+func (c Config) httpClient() (*http.Client, error) {
+	if err := c.checkProxy(); err != nil {
+		return nil, err
+	}
+	if c.HTTPClient != nil {
+		return c.HTTPClient, nil
+	}
+	if c.Proxy != nil {
+		// Validates the proxy the same way peers would so trackers never go direct by accident
+		_, err := c.peerDialer()
+		if err != nil {
+			return nil, err
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = c.directDialer().DialContext
+	if c.TrackerTLS != nil {
+		transport.TLSClientConfig = c.TrackerTLS.Clone()
+	}
+	if c.Proxy != nil {
+		transport.Proxy = http.ProxyURL(c.Proxy)
+	}
+	return &http.Client{Transport: transport}, nil
+}
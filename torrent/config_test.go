@@ -0,0 +1,47 @@
+package torrent
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bitTorrent/peer"
+)
+
+func TestHTTPClientWithProxy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HTTPClient = &http.Client{}
+	cfg.Proxy = &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"}
+	if _, err := cfg.httpClient(); err == nil {
+		t.Error("tracker client ignored the proxy without an error")
+	}
+	if _, err := cfg.clientOptions(); err == nil {
+		t.Error("peer options accepted a proxy the trackers would bypass")
+	}
+
+	cfg.Proxy = nil
+	client, err := cfg.httpClient()
+	if err != nil || client != cfg.HTTPClient {
+		t.Errorf("got %v, %v, want the supplied client", client, err)
+	}
+}
+
+func TestDownloadRejectsZeroTimeouts(t *testing.T) {
+	for name, set := range map[string]func(*Config){
+		"ConnectTimeout":   func(c *Config) { c.ConnectTimeout = 0 },
+		"HandshakeTimeout": func(c *Config) { c.HandshakeTimeout = -time.Second },
+		"UnchokeTimeout":   func(c *Config) { c.UnchokeTimeout = 0 },
+		"PieceIdleTimeout": func(c *Config) { c.PieceIdleTimeout = 0 },
+		"MaxBackoff":       func(c *Config) { c.MaxBackoff = 0 },
+	} {
+		tor := newTestTorrent(testData(1024), 1024)
+		tor.Peers = []peer.Peer{peer.NewPeer(net.IP{127, 0, 0, 1}, 1)}
+		set(&tor.Config)
+		if _, err := tor.Download(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: got %v, want it rejected", name, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"sync"
+
+	"bitTorrent/helpers/bitfield"
+	"bitTorrent/peer"
+)
+
+type Coverage struct {
+	PiecesTotal     int
+	PiecesAvailable int            // pieces at least one reachable peer has
+	PeersReached    int            // peers that completed the handshake and sent a bitfield
+	PeerPieces      map[string]int // pieces each reachable peer has, by address
+}
+
+func (c Coverage) Complete() bool {
+	return c.PiecesAvailable == c.PiecesTotal
+}
+
+// Connects to every peer, only to read its bitfield, and reports how much of the
+// torrent the set of them could provide together. Nothing is downloaded.
+func SwarmCoverage(t *Torrent, peers []peer.Peer) (Coverage, error) {
+	opts, err := t.Config.clientOptions()
+	if err != nil {
+		return Coverage{}, err
+	}
+	opts.Reserved = t.reserved()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	union := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	coverage := Coverage{PiecesTotal: len(t.PieceHashes), PeerPieces: map[string]int{}}
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := peer.NewClient(p, t.PeerID, t.InfoHash, opts)
+			if err != nil {
+				debugLog.Printf("Could Not Reach %s: %v", p, err)
+				return
+			}
+			client.Conn.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			has := 0
+			for index := range t.PieceHashes {
+				if client.Bitfield.CheckPiece(index) {
+					union.SetPiece(index)
+					has++
+				}
+			}
+			coverage.PeersReached++
+			coverage.PeerPieces[p.String()] = has
+		}()
+	}
+	wg.Wait()
+
+	for index := range t.PieceHashes {
+		if union.CheckPiece(index) {
+			coverage.PiecesAvailable++
+		}
+	}
+	return coverage, nil
+}
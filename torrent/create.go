@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Piece length Create uses when CreateOptions leaves it at 0
+const DefaultCreatePieceLength = 256 * 1024
+
+type CreateOptions struct {
+	// Power of two and at least BLOCKSIZE, 0 means DefaultCreatePieceLength
+	PieceLength int
+	Announce    string
+	// Tiers of trackers (BEP12), Announce is usually the first of the first tier
+	AnnounceList [][]string
+	Private      bool
+	Source       string
+}
+
+// Hashes the file or directory at root and writes a .torrent for it to w.
+// A directory becomes a multi file torrent named after it, its files in
+// lexical order. Returns the infohash of the new torrent.
+func Create(w io.Writer, root string, opts CreateOptions) ([20]byte, error) {
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = DefaultCreatePieceLength
+	}
+	if pieceLength < BLOCKSIZE || pieceLength&(pieceLength-1) != 0 {
+		return [20]byte{}, fmt.Errorf("piece length %d is not a power of two of at least %d", pieceLength, BLOCKSIZE)
+	}
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	info := bencodeInfo{PieceLength: pieceLength, Name: filepath.Base(filepath.Clean(root)), Source: opts.Source}
+	if opts.Private {
+		info.Private = 1
+	}
+	var paths []string
+	if stat.IsDir() {
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return fmt.Errorf("%s is not a regular file", path)
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			info.Files = append(info.Files, bencodeFile{Length: int(fi.Size()), Path: strings.Split(filepath.ToSlash(rel), "/")})
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil {
+			return [20]byte{}, err
+		}
+		if len(paths) == 0 {
+			return [20]byte{}, fmt.Errorf("%s has no files", root)
+		}
+	} else {
+		info.Length = int(stat.Size())
+		paths = []string{root}
+	}
+
+	info.Pieces, err = hashFiles(paths, pieceLength)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	if info.Pieces == "" {
+		return [20]byte{}, fmt.Errorf("%s is empty", root)
+	}
+
+	var buffer bytes.Buffer
+	err = bencode.Marshal(&buffer, bencodeTorrent{Announce: opts.Announce, AnnounceList: opts.AnnounceList, Info: info})
+	if err != nil {
+		return [20]byte{}, err
+	}
+	// Hashing what we actually wrote keeps the result identical to what Open computes
+	rawInfo, err := extractInfoDict(buffer.Bytes())
+	if err != nil {
+		return [20]byte{}, err
+	}
+	infoHash := sha1.Sum(rawInfo)
+	_, err = w.Write(buffer.Bytes())
+	return infoHash, err
+}
+
+// Concatenates the SHA-1 of every piece, pieces run across file boundaries like on the wire
+func hashFiles(paths []string, pieceLength int) (string, error) {
+	var pieces strings.Builder
+	buf := make([]byte, pieceLength)
+	filled := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		for {
+			n, err := io.ReadFull(file, buf[filled:])
+			filled += n
+			if filled == pieceLength {
+				sum := sha1.Sum(buf)
+				pieces.Write(sum[:])
+				filled = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return "", err
+			}
+		}
+		file.Close()
+	}
+	if filled > 0 {
+		sum := sha1.Sum(buf[:filled])
+		pieces.Write(sum[:])
+	}
+	return pieces.String(), nil
+}
@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestCreateRoundTrip(t *testing.T) {
+	// None of the files end on a piece boundary so pieces run across them
+	root := filepath.Join(t.TempDir(), "album")
+	files := []struct {
+		path string
+		data []byte
+	}{
+		{"a.txt", testData(3*BLOCKSIZE + 17)},
+		{"sub/b.bin", testData(5)},
+		{"sub/c.bin", testData(2*BLOCKSIZE - 1)},
+		{"z", testData(BLOCKSIZE)},
+	}
+	var all []byte
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, f.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, f.data...)
+	}
+
+	var buf bytes.Buffer
+	opts := CreateOptions{
+		PieceLength:  BLOCKSIZE,
+		Announce:     "http://tracker.test/announce",
+		AnnounceList: [][]string{{"http://tracker.test/announce"}, {"udp://backup.test:80"}},
+		Private:      true,
+		Source:       "TEST",
+	}
+	infoHash, err := Create(&buf, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := OpenBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf.InfoHash != infoHash {
+		t.Errorf("Create returned %x, the file has %x", infoHash, tf.InfoHash)
+	}
+	if tf.Name != "album" || tf.Length != len(all) || tf.PieceLength != BLOCKSIZE ||
+		!tf.Private || tf.Source != "TEST" || tf.Announce != opts.Announce ||
+		!reflect.DeepEqual(tf.AnnounceList, opts.AnnounceList) {
+		t.Errorf("got %+v", tf)
+	}
+	var want [][20]byte
+	for begin := 0; begin < len(all); begin += BLOCKSIZE {
+		want = append(want, sha1.Sum(all[begin:min(begin+BLOCKSIZE, len(all))]))
+	}
+	if len(tf.PieceHashes) != 7 || !reflect.DeepEqual(tf.PieceHashes, want) {
+		t.Errorf("got %d piece hashes, want the %d of the concatenated files", len(tf.PieceHashes), len(want))
+	}
+	wantFiles := []File{
+		{Path: []string{"a.txt"}, Length: len(files[0].data)},
+		{Path: []string{"sub", "b.bin"}, Length: len(files[1].data)},
+		{Path: []string{"sub", "c.bin"}, Length: len(files[2].data)},
+		{Path: []string{"z"}, Length: len(files[3].data)},
+	}
+	if !reflect.DeepEqual(tf.Files, wantFiles) {
+		t.Errorf("got files %+v, want %+v", tf.Files, wantFiles)
+	}
+
+	// The decoded info dictionary encodes back to exactly the bytes that were hashed
+	bto, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info bytes.Buffer
+	if err := bencode.Marshal(&info, bto.Info); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(info.Bytes(), bto.rawInfo) {
+		t.Errorf("info dictionary changed on a round trip:\n%q\n%q", info.Bytes(), bto.rawInfo)
+	}
+	bto.rawInfo = nil
+	rebuilt, err := bto.ToTorrentFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rebuilt, tf) {
+		t.Errorf("rebuilt from the decoded info dictionary:\n%+v\nwant\n%+v", rebuilt, tf)
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.iso")
+	data := testData(BLOCKSIZE + 1)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	infoHash, err := Create(&buf, path, CreateOptions{PieceLength: BLOCKSIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := OpenBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.InfoHash != infoHash || tf.Name != "file.iso" || tf.Length != len(data) || tf.Files != nil {
+		t.Errorf("got %+v", tf)
+	}
+	want := [][20]byte{sha1.Sum(data[:BLOCKSIZE]), sha1.Sum(data[BLOCKSIZE:])}
+	if !reflect.DeepEqual(tf.PieceHashes, want) {
+		t.Error("piece hashes differ")
+	}
+
+	for _, pieceLength := range []int{BLOCKSIZE / 2, BLOCKSIZE + 1} {
+		if _, err := Create(&buf, path, CreateOptions{PieceLength: pieceLength}); err == nil {
+			t.Errorf("piece length %d was accepted", pieceLength)
+		}
+	}
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(&buf, empty, CreateOptions{}); err == nil {
+		t.Error("an empty file was accepted")
+	}
+}
@@ -0,0 +1,342 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitTorrent/helpers/bitfield"
+	"bitTorrent/helpers/ipfilter"
+	"bitTorrent/message"
+	"bitTorrent/peer"
+)
+
+func TestMain(m *testing.M) {
+	// Every download logs its start, keep the test output readable
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// A Torrent for data cut into pieceLength pieces with short timeouts and no stdout progress
+func newTestTorrent(data []byte, pieceLength int) *Torrent {
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		hashes = append(hashes, sha1.Sum(data[begin:min(begin+pieceLength, len(data))]))
+	}
+	cfg := DefaultConfig()
+	cfg.DialsPerSecond = 0
+	cfg.ConnectTimeout = time.Second
+	cfg.HandshakeTimeout = time.Second
+	cfg.UnchokeTimeout = 2 * time.Second
+	cfg.PieceIdleTimeout = 2 * time.Second
+	cfg.MaxBackoff = 100 * time.Millisecond
+	cfg.OnProgress = func(Stats) {}
+	return &Torrent{
+		PeerID:      [20]byte{'t', 'e', 's', 't'},
+		InfoHash:    sha1.Sum(data),
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+		Config:      cfg,
+	}
+}
+
+func testData(length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+type blockRequest struct {
+	index, begin, length int
+}
+
+// One connection to a fakeSeeder
+type seederConn struct {
+	conn   net.Conn
+	seeder *fakeSeeder
+}
+
+func (c *seederConn) send(msg *message.Message) error {
+	_, err := c.conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *seederConn) sendPiece(index, begin int, data []byte) error {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return c.send(&message.Message{ID: message.MsgPiece, Payload: payload})
+}
+
+// Sends the requested block straight out of the seeder's data
+func (c *seederConn) answer(r blockRequest) error {
+	begin := r.index*c.seeder.pieceLength + r.begin
+	return c.sendPiece(r.index, r.begin, c.seeder.data[begin:begin+r.length])
+}
+
+// Seeds data to whoever connects. onRequest replaces answering a request
+// straight away, it runs on the connection's goroutine.
+type fakeSeeder struct {
+	ln          net.Listener
+	data        []byte
+	pieceLength int
+	infoHash    [20]byte
+	onRequest   func(c *seederConn, r blockRequest) error
+
+	mu       sync.Mutex
+	requests []blockRequest
+	conns    []net.Conn
+}
+
+func newFakeSeeder(t testing.TB, tor *Torrent, data []byte) *fakeSeeder {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSeeder{ln: ln, data: data, pieceLength: tor.PieceLength, infoHash: tor.InfoHash}
+	t.Cleanup(s.close)
+	go s.serve(len(tor.PieceHashes))
+	return s
+}
+
+func (s *fakeSeeder) peer() peer.Peer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return peer.NewPeer(addr.IP, uint16(addr.Port))
+}
+
+func (s *fakeSeeder) close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Every block request received so far, across connections
+func (s *fakeSeeder) received() []blockRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]blockRequest(nil), s.requests...)
+}
+
+func (s *fakeSeeder) serve(numPieces int) {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn, numPieces)
+	}
+}
+
+func (s *fakeSeeder) handle(conn net.Conn, numPieces int) {
+	defer conn.Close()
+	if _, err := peer.ReadHandShake(conn); err != nil {
+		return
+	}
+	if _, err := conn.Write(peer.New(s.infoHash, [20]byte{'s', 'e', 'e', 'd'}).Serialize()); err != nil {
+		return
+	}
+	have := make(bitfield.Bitfield, (numPieces+7)/8)
+	for index := range numPieces {
+		have.SetPiece(index)
+	}
+	c := &seederConn{conn: conn, seeder: s}
+	if c.send(&message.Message{ID: message.MsgBitField, Payload: have}) != nil ||
+		c.send(&message.Message{ID: message.MsgUnchoke}) != nil {
+		return
+	}
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgRequest || len(msg.Payload) != 12 {
+			continue
+		}
+		r := blockRequest{
+			index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+			begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+			length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.mu.Unlock()
+		if s.onRequest != nil {
+			err = s.onRequest(c, r)
+		} else {
+			err = c.answer(r)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Runs Download and fails the test unless it returns data within timeout
+func downloadWithin(t *testing.T, tor *Torrent, timeout time.Duration) []byte {
+	t.Helper()
+	type result struct {
+		buf []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		buf, err := tor.Download()
+		done <- result{buf, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return res.buf
+	case <-time.After(timeout):
+		t.Fatalf("download did not finish within %s", timeout)
+	}
+	return nil
+}
+
+func TestDownloadGivesUpWithoutPeers(t *testing.T) {
+	data := testData(4096)
+	tor := newTestTorrent(data, 1024)
+	tor.Config.MaxReconnectAttempts = 1
+
+	// Nothing listens here any more so every dial is refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	tor.Peers = []peer.Peer{peer.NewPeer(addr.IP, uint16(addr.Port))}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tor.Download()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoPeers) {
+			t.Fatalf("got %v, want ErrNoPeers", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download kept waiting after its only peer gave up")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	data := testData(10000)
+	tor := newTestTorrent(data, 4096)
+	tor.Peers = []peer.Peer{newFakeSeeder(t, tor, data).peer()}
+	buf := downloadWithin(t, tor, 10*time.Second)
+	if string(buf) != string(data) {
+		t.Fatal("downloaded data differs")
+	}
+}
+
+func TestDownloadGivesUpWhenEveryPeerIsBlocked(t *testing.T) {
+	data := testData(4096)
+	tor := newTestTorrent(data, 1024)
+	tor.Peers = []peer.Peer{newFakeSeeder(t, tor, data).peer()}
+	filter, err := ipfilter.Parse(strings.NewReader("127.0.0.0/8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.Config.Blocklist = filter
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tor.Download()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoPeers) {
+			t.Fatalf("got %v, want ErrNoPeers", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download kept waiting with every peer blocked")
+	}
+}
+
+func TestPeerThatDropsAfterUnchokeRunsOutOfAttempts(t *testing.T) {
+	data := testData(4096)
+	tor := newTestTorrent(data, 1024)
+	tor.Config.MaxReconnectAttempts = 3
+	seeder := newFakeSeeder(t, tor, data)
+	// Unchokes us like every fake seeder, then hangs up on the first request
+	seeder.onRequest = func(c *seederConn, r blockRequest) error {
+		return errors.New("drop")
+	}
+	tor.Peers = []peer.Peer{seeder.peer()}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tor.Download()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoPeers) {
+			t.Fatalf("got %v, want ErrNoPeers", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("peer kept being redialed")
+	}
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if len(seeder.conns) != tor.Config.MaxReconnectAttempts {
+		t.Errorf("peer was dialed %d times, want %d", len(seeder.conns), tor.Config.MaxReconnectAttempts)
+	}
+}
+
+func TestDownloadLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	data := testData(50000)
+	tor := newTestTorrent(data, 4096)
+	seeders := []*fakeSeeder{newFakeSeeder(t, tor, data), newFakeSeeder(t, tor, data)}
+	for _, s := range seeders {
+		tor.Peers = append(tor.Peers, s.peer())
+	}
+	downloadWithin(t, tor, 10*time.Second)
+
+	// Our side has to be gone by the time Download returns. The seeders are left running,
+	// closing them would unblock a leaked worker; only their accept loops may remain
+	tor.peersMu.Lock()
+	connected := len(tor.connected)
+	tor.peersMu.Unlock()
+	if connected != 0 {
+		t.Errorf("%d peers still connected after Download returned", connected)
+	}
+	want := before + len(seeders)
+	// The seeders' connection goroutines notice our closed sockets on their own time
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > want {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines before the download, %d after:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
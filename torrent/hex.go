@@ -0,0 +1,35 @@
+package torrent
+
+import "encoding/hex"
+
+// Lowercase hex of the infohash, the form trackers' web pages and magnet links use
+func (tf *TorrentFile) InfoHashString() string {
+	return hex.EncodeToString(tf.InfoHash[:])
+}
+
+func (tf *TorrentFile) InfoHashHex() string {
+	return tf.InfoHashString()
+}
+
+func (tf *TorrentFile) PieceHashHex(index int) string {
+	return pieceHashHex(tf.PieceHashes, index)
+}
+
+func (t *Torrent) InfoHashString() string {
+	return hex.EncodeToString(t.InfoHash[:])
+}
+
+func (t *Torrent) InfoHashHex() string {
+	return t.InfoHashString()
+}
+
+func (t *Torrent) PieceHashHex(index int) string {
+	return pieceHashHex(t.PieceHashes, index)
+}
+
+func pieceHashHex(hashes [][20]byte, index int) string {
+	if index < 0 || index >= len(hashes) {
+		return ""
+	}
+	return hex.EncodeToString(hashes[index][:])
+}
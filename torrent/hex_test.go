@@ -0,0 +1,23 @@
+package torrent
+
+import "testing"
+
+func TestHashStrings(t *testing.T) {
+	tf := TorrentFile{
+		InfoHash:    [20]byte{0xde, 0xad, 0xbe, 0xef},
+		PieceHashes: [][20]byte{{0x01}, {0xff}},
+	}
+	const want = "deadbeef00000000000000000000000000000000"
+	if got := tf.InfoHashString(); got != want {
+		t.Errorf("InfoHashString() = %s, want %s", got, want)
+	}
+	if got := tf.ToTorrent(nil, [20]byte{}).InfoHashString(); got != want {
+		t.Errorf("Torrent.InfoHashString() = %s, want %s", got, want)
+	}
+	if got := tf.PieceHashHex(1); got != "ff00000000000000000000000000000000000000" {
+		t.Errorf("PieceHashHex(1) = %s", got)
+	}
+	if got := tf.PieceHashHex(2); got != "" {
+		t.Errorf("PieceHashHex out of range = %q, want empty", got)
+	}
+}
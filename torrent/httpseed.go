@@ -0,0 +1,124 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitTorrent/helpers/bitfield"
+)
+
+// Downloads pieces from one BEP17 web seed until the download ends. The seed has
+// every piece so it counts towards availability like a seeding peer would.
+func (t *Torrent) httpSeedWorker(seedURL string, s *swarm) {
+	// BEP19 url-list style seeds point at the files themselves, usually a directory
+	// ending in a slash, and do not understand piece requests
+	if strings.HasSuffix(seedURL, "/") {
+		log.Printf("Skipping Web Seed %s, It Looks Like A BEP19 url-list Seed Which Is Not Supported", seedURL)
+		return
+	}
+	client, err := t.Config.httpClient()
+	if err != nil {
+		log.Printf("Web Seed %s: %v", seedURL, err)
+		return
+	}
+	all := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	for index := range t.PieceHashes {
+		all.SetPiece(index)
+	}
+	s.picker.addPeer(all)
+	defer s.picker.removePeer(all)
+
+	backoff := time.Second
+	attempts := 0
+	for !s.picker.isClosed() {
+		pw, _ := s.picker.tryNext(all)
+		if pw == nil {
+			if !sleepCtx(s.ctx, idlePollInterval) {
+				return
+			}
+			continue
+		}
+		buf, err := t.fetchSeedPiece(client, seedURL, pw, s)
+		if err != nil {
+			s.picker.requeue(pw)
+			s.picker.release()
+			debugLog.Printf("Web Seed %s Piece %d: %v", seedURL, pw.index, err)
+			// A busy seed names its own delay, it still uses up an attempt so one that
+			// stays busy is given up on like a dead one
+			wait := &backoff
+			var busy *seedBusyError
+			if errors.As(err, &busy) {
+				wait = &busy.retry
+			}
+			if !t.waitBeforeReconnect(s.ctx, seedURL, wait, &attempts) {
+				return
+			}
+			continue
+		}
+		backoff = time.Second
+		attempts = 0
+		// Goes through the verifiers like a piece from a peer, a bad hash requeues it
+		select {
+		case s.results <- &pieceResult{pw.index, buf, pw}:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// A 503 from a BEP17 seed, its body says how many seconds to wait before asking again
+type seedBusyError struct {
+	retry time.Duration
+}
+
+func (e *seedBusyError) Error() string {
+	return fmt.Sprintf("http seed is busy, retry in %s", e.retry)
+}
+
+// Asks for a whole piece with ?info_hash=...&piece=N the way BEP17 describes
+func (t *Torrent) fetchSeedPiece(client *http.Client, seedURL string, pw *pieceWork, s *swarm) ([]byte, error) {
+	base, err := url.Parse(seedURL)
+	if err != nil {
+		return nil, err
+	}
+	query := base.Query()
+	query.Set("piece", strconv.Itoa(pw.index))
+	base.RawQuery = "info_hash=" + percentEncode(t.InfoHash[:]) + "&" + query.Encode()
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+		seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil || seconds <= 0 {
+			seconds = 30
+		}
+		return nil, &seedBusyError{retry: time.Duration(seconds) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http seed answered %s", resp.Status)
+	}
+	buf := make([]byte, pw.length)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, fmt.Errorf("short piece from http seed: %w", err)
+	}
+	if n, _ := io.Copy(io.Discard, io.LimitReader(resp.Body, 1)); n > 0 {
+		return nil, fmt.Errorf("http seed sent more than the %d bytes of piece %d", pw.length, pw.index)
+	}
+	return buf, nil
+}
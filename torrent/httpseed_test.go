@@ -0,0 +1,41 @@
+package torrent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadGivesUpOnFailingWebSeed(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	data := testData(4096)
+	tor := newTestTorrent(data, 1024)
+	tor.Config.MaxReconnectAttempts = 2
+	tor.HTTPSeeds = []string{srv.URL + "/seed"}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tor.Download()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoPeers) {
+			t.Fatalf("got %v, want ErrNoPeers", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download kept retrying a web seed that only answers 404")
+	}
+	if n := hits.Load(); n != int32(tor.Config.MaxReconnectAttempts) {
+		t.Errorf("web seed was asked %d times, want %d", n, tor.Config.MaxReconnectAttempts)
+	}
+}
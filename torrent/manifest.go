@@ -0,0 +1,61 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var ErrManifestMismatch = errors.New("downloaded file does not match the manifest")
+
+// SHA-256 of every file as stored in r, hex encoded and keyed by its path inside
+// the download: Name for a single file torrent, Name/dir/file otherwise.
+// Hashing what was written catches offset and splitting mistakes that piece
+// hashes, taken before the write, can not.
+func (t *Torrent) HashFiles(r io.ReaderAt) (map[string]string, error) {
+	paths := [][]string{{t.Name}}
+	lengths := []int{t.Length}
+	if len(t.Files) > 0 {
+		paths, lengths = nil, nil
+		for _, f := range t.Files {
+			paths = append(paths, append([]string{t.Name}, f.Path...))
+			lengths = append(lengths, f.Length)
+		}
+	}
+	hashes := make(map[string]string, len(paths))
+	offset := int64(0)
+	for i, parts := range paths {
+		h := sha256.New()
+		_, err := io.Copy(h, io.NewSectionReader(r, offset, int64(lengths[i])))
+		if err != nil {
+			return nil, fmt.Errorf("hashing %s: %w", strings.Join(parts, "/"), err)
+		}
+		hashes[strings.Join(parts, "/")] = hex.EncodeToString(h.Sum(nil))
+		offset += int64(lengths[i])
+	}
+	return hashes, nil
+}
+
+// Every file in the manifest has to be in the torrent with the same hash,
+// files the manifest leaves out are not checked
+func checkManifest(manifest, hashes map[string]string) error {
+	paths := make([]string, 0, len(manifest))
+	for path := range manifest {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		got, ok := hashes[path]
+		if !ok {
+			return fmt.Errorf("%w: %s is not part of the torrent", ErrManifestMismatch, path)
+		}
+		if !strings.EqualFold(got, manifest[path]) {
+			return fmt.Errorf("%w: %s has SHA-256 %s, expected %s", ErrManifestMismatch, path, got, manifest[path])
+		}
+	}
+	return nil
+}
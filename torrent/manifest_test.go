@@ -0,0 +1,42 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Resume data that marks every piece done skips the download, not the file checks
+func TestManifestCheckedWhenEveryPieceIsResumed(t *testing.T) {
+	data := testData(3000)
+	sum := sha256.Sum256(data)
+	manifest := map[string]string{"test": hex.EncodeToString(sum[:])}
+
+	resumed := func() *Torrent {
+		tor := newTestTorrent(data, 1024)
+		tor.Config.FileManifest = manifest
+		tor.initCompleted()
+		for index := range tor.PieceHashes {
+			tor.markCompleted(index)
+		}
+		return tor
+	}
+
+	tor := resumed()
+	var completed *Stats
+	tor.Config.OnComplete = func(s Stats) { completed = &s }
+	if err := tor.DownloadTo(memoryWriter(append([]byte(nil), data...))); err != nil {
+		t.Fatalf("intact files without peers: %v", err)
+	}
+	if completed == nil || completed.FileHashes["test"] != manifest["test"] {
+		t.Errorf("OnComplete got %+v", completed)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[1500] ^= 0xff
+	tor = resumed()
+	if err := tor.DownloadTo(memoryWriter(tampered)); !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("got %v, want ErrManifestMismatch", err)
+	}
+}
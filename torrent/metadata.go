@@ -0,0 +1,225 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+
+	"bitTorrent/message"
+	"bitTorrent/peer"
+)
+
+// BEP9 metadata exchange, used to turn an infohash into a TorrentFile
+
+const metadataPieceSize = 16384
+
+// Largest info dictionary we are willing to buffer from a peer
+const maxMetadataSize = 16 << 20
+
+// The id peers must use when sending ut_metadata messages to us
+const localMetadataID = 1
+
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+var ErrMetadataMismatch = errors.New("metadata does not match the infohash")
+
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	Port         int            `bencode:"p,omitempty"`      // the sender's listen port
+	YourIP       string         `bencode:"yourip,omitempty"` // the receiver's address as the sender sees it
+}
+
+func (c Config) localExtendedHandshake(m map[string]int) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := bencode.Marshal(&buffer, extendedHandshake{M: m, Port: int(c.announcePort())})
+	return buffer.Bytes(), err
+}
+
+// Records the peer's extensions on client and passes the address it reflected back to us to OnExternalIP
+func (c Config) handleExtendedHandshake(client *peer.Client, payload []byte) error {
+	handshake := extendedHandshake{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &handshake)
+	if err != nil {
+		return err
+	}
+	client.SetExtensions(handshake.M)
+	c.reportYourIP(handshake.YourIP)
+	return nil
+}
+
+func (c Config) reportYourIP(yourIP string) {
+	if c.OnExternalIP != nil && (len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		c.OnExternalIP(net.IP(yourIP))
+	}
+}
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Tries each peer in turn until one serves metadata matching infoHash
+func FetchMetadata(peers []peer.Peer, infoHash, peerID [20]byte, cfg Config) (TorrentFile, error) {
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	opts.Reserved[5] |= reservedExtension
+
+	var lastErr error = ErrNoPeers
+	for _, p := range peers {
+		tf, err := fetchMetadataFromPeer(p, infoHash, peerID, opts, cfg)
+		if err == nil {
+			return tf, nil
+		}
+		debugLog.Printf("Could Not Fetch Metadata From %s: %v", p.IP, err)
+		lastErr = err
+	}
+	return TorrentFile{}, lastErr
+}
+
+func fetchMetadataFromPeer(p peer.Peer, infoHash, peerID [20]byte, opts peer.Options, cfg Config) (TorrentFile, error) {
+	client, err := peer.NewClient(p, peerID, infoHash, opts)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	defer client.Conn.Close()
+
+	if !client.SupportsExtensionProtocol() {
+		return TorrentFile{}, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	client.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer client.Conn.SetDeadline(time.Time{})
+
+	payload, err := cfg.localExtendedHandshake(map[string]int{"ut_metadata": localMetadataID})
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	err = client.SendExtended(0, payload)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	remote, err := readExtendedHandshake(client)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	cfg.reportYourIP(remote.YourIP)
+	client.SetExtensions(remote.M)
+	remoteID, ok := client.ExtensionID("ut_metadata")
+	if !ok {
+		return TorrentFile{}, fmt.Errorf("peer does not support ut_metadata")
+	}
+	if remote.MetadataSize <= 0 || remote.MetadataSize > maxMetadataSize {
+		return TorrentFile{}, fmt.Errorf("peer advertised an invalid metadata_size %d", remote.MetadataSize)
+	}
+
+	raw, err := requestMetadataPieces(client, remoteID, remote.MetadataSize)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	if sha1.Sum(raw) != infoHash {
+		return TorrentFile{}, ErrMetadataMismatch
+	}
+
+	info := bencodeInfo{}
+	err = bencode.Unmarshal(bytes.NewReader(raw), &info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return info.toTorrentFile("", infoHash)
+}
+
+func readExtendedHandshake(client *peer.Client) (*extendedHandshake, error) {
+	for {
+		msg, err := client.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended || len(msg.Payload) == 0 || msg.Payload[0] != 0 {
+			continue
+		}
+		handshake := extendedHandshake{}
+		err = bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), &handshake)
+		if err != nil {
+			return nil, err
+		}
+		return &handshake, nil
+	}
+}
+
+func requestMetadataPieces(client *peer.Client, remoteID uint8, size int) ([]byte, error) {
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	for piece := 0; piece < numPieces; piece++ {
+		var buffer bytes.Buffer
+		err := bencode.Marshal(&buffer, metadataMessage{MsgType: metadataRequest, Piece: piece})
+		if err != nil {
+			return nil, err
+		}
+		err = client.SendExtended(remoteID, buffer.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	raw := make([]byte, size)
+	received := make([]bool, numPieces)
+	remaining := numPieces
+	for remaining > 0 {
+		msg, err := client.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended || len(msg.Payload) == 0 || msg.Payload[0] != localMetadataID {
+			continue
+		}
+
+		// The bencoded header is followed directly by the raw piece bytes
+		reader := bufio.NewReader(bytes.NewReader(msg.Payload[1:]))
+		header := metadataMessage{}
+		err = bencode.Unmarshal(reader, &header)
+		if err != nil {
+			return nil, err
+		}
+		if header.MsgType == metadataReject {
+			return nil, fmt.Errorf("peer rejected metadata piece %d", header.Piece)
+		}
+		if header.MsgType != metadataData {
+			continue
+		}
+		if header.Piece < 0 || header.Piece >= numPieces {
+			return nil, fmt.Errorf("peer sent unknown metadata piece %d", header.Piece)
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		begin := header.Piece * metadataPieceSize
+		end := min(begin+metadataPieceSize, size)
+		if len(data) != end-begin {
+			return nil, fmt.Errorf("metadata piece %d has length %d, expected %d", header.Piece, len(data), end-begin)
+		}
+		copy(raw[begin:end], data)
+		if !received[header.Piece] {
+			received[header.Piece] = true
+			remaining--
+		}
+	}
+	return raw, nil
+}
@@ -0,0 +1,222 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+
+	"bitTorrent/message"
+	"bitTorrent/peer"
+)
+
+// The ut_metadata id the fake peer wants its requests sent with
+const fakeMetadataID = 3
+
+// Serves info over BEP9 ut_metadata in metadataPieceSize pieces, last piece first
+type fakeMetadataPeer struct {
+	ln   net.Listener
+	info []byte
+	// Advertised as metadata_size instead of len(info) when set
+	size int
+	// Rejects every request instead of answering
+	reject bool
+	// Cuts a byte off every piece it sends
+	short bool
+}
+
+func newFakeMetadataPeer(t *testing.T, info []byte) *fakeMetadataPeer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMetadataPeer{ln: ln, info: info}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeMetadataPeer) peer() peer.Peer {
+	addr := f.ln.Addr().(*net.TCPAddr)
+	return peer.NewPeer(addr.IP, uint16(addr.Port))
+}
+
+func (f *fakeMetadataPeer) send(conn net.Conn, id uint8, header metadataMessage, data []byte) error {
+	var buffer bytes.Buffer
+	buffer.WriteByte(id)
+	if err := bencode.Marshal(&buffer, header); err != nil {
+		return err
+	}
+	buffer.Write(data)
+	_, err := conn.Write((&message.Message{ID: message.MsgExtended, Payload: buffer.Bytes()}).Serialize())
+	return err
+}
+
+func (f *fakeMetadataPeer) handle(conn net.Conn) {
+	defer conn.Close()
+	h, err := peer.ReadHandShake(conn)
+	if err != nil {
+		return
+	}
+	ours := peer.New(h.InfoHash, [20]byte{'m', 'e', 't', 'a'})
+	ours.Reserved[5] |= 0x10
+	if _, err := conn.Write(ours.Serialize()); err != nil {
+		return
+	}
+	if _, err := conn.Write((&message.Message{ID: message.MsgBitField, Payload: []byte{0}}).Serialize()); err != nil {
+		return
+	}
+
+	size := f.size
+	if size == 0 {
+		size = len(f.info)
+	}
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	var requested []int
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgExtended || len(msg.Payload) == 0 {
+			continue
+		}
+		switch msg.Payload[0] {
+		case 0:
+			var buffer bytes.Buffer
+			buffer.WriteByte(0)
+			bencode.Marshal(&buffer, extendedHandshake{M: map[string]int{"ut_metadata": fakeMetadataID}, MetadataSize: size})
+			if _, err := conn.Write((&message.Message{ID: message.MsgExtended, Payload: buffer.Bytes()}).Serialize()); err != nil {
+				return
+			}
+		case fakeMetadataID:
+			var req metadataMessage
+			if bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), &req) != nil || req.MsgType != metadataRequest {
+				return
+			}
+			if f.reject {
+				f.send(conn, localMetadataID, metadataMessage{MsgType: metadataReject, Piece: req.Piece}, nil)
+				continue
+			}
+			requested = append(requested, req.Piece)
+			if len(requested) < numPieces {
+				continue
+			}
+			// Answered back to front so the pieces have to be put in place by index
+			slices.Reverse(requested)
+			for _, piece := range requested {
+				begin := piece * metadataPieceSize
+				end := min(begin+metadataPieceSize, len(f.info))
+				data := f.info[begin:end]
+				if f.short {
+					data = data[:len(data)-1]
+				}
+				header := metadataMessage{MsgType: metadataData, Piece: piece, TotalSize: size}
+				if f.send(conn, localMetadataID, header, data) != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// An info dictionary a little over three metadata pieces long, so the last piece is short
+func testInfoDict(t *testing.T, name string) []byte {
+	numPieces := 2500
+	pieces := make([]byte, 20*numPieces)
+	for i := range pieces {
+		pieces[i] = byte(i)
+	}
+	var buffer bytes.Buffer
+	err := bencode.Marshal(&buffer, bencodeInfo{
+		Pieces:      string(pieces),
+		PieceLength: BLOCKSIZE,
+		Length:      numPieces * BLOCKSIZE,
+		Name:        name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func testMetadataConfig() Config {
+	cfg := DefaultConfig()
+	cfg.ConnectTimeout = time.Second
+	cfg.HandshakeTimeout = time.Second
+	return cfg
+}
+
+func TestFetchMetadata(t *testing.T) {
+	info := testInfoDict(t, "meta")
+	if len(info) <= 3*metadataPieceSize {
+		t.Fatalf("info dictionary of %d bytes fits in three pieces", len(info))
+	}
+	infoHash := sha1.Sum(info)
+	tf, err := FetchMetadata([]peer.Peer{newFakeMetadataPeer(t, info).peer()}, infoHash, [20]byte{'t'}, testMetadataConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.InfoHash != infoHash || tf.Name != "meta" || len(tf.PieceHashes) != 2500 || tf.PieceHashes[1][0] != 20 {
+		t.Errorf("got %s with %d pieces", tf.Name, len(tf.PieceHashes))
+	}
+}
+
+func TestFetchMetadataRejectsBadPeers(t *testing.T) {
+	info := testInfoDict(t, "meta")
+	infoHash := sha1.Sum(info)
+	tests := []struct {
+		name  string
+		setup func(f *fakeMetadataPeer)
+		want  string
+	}{
+		{"other torrent", func(f *fakeMetadataPeer) { f.info = testInfoDict(t, "other") }, ErrMetadataMismatch.Error()},
+		{"oversized", func(f *fakeMetadataPeer) { f.size = maxMetadataSize + 1 }, "invalid metadata_size"},
+		{"rejected", func(f *fakeMetadataPeer) { f.reject = true }, "rejected metadata piece"},
+		{"short piece", func(f *fakeMetadataPeer) { f.short = true }, "has length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeMetadataPeer(t, info)
+			tt.setup(f)
+			_, err := FetchMetadata([]peer.Peer{f.peer()}, infoHash, [20]byte{'t'}, testMetadataConfig())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchMetadataTriesTheNextPeer(t *testing.T) {
+	info := testInfoDict(t, "meta")
+	infoHash := sha1.Sum(info)
+	liar := newFakeMetadataPeer(t, testInfoDict(t, "other"))
+	honest := newFakeMetadataPeer(t, info)
+
+	tf, err := FetchMetadata([]peer.Peer{liar.peer(), honest.peer()}, infoHash, [20]byte{'t'}, testMetadataConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.InfoHash != infoHash {
+		t.Errorf("got metadata for %x", tf.InfoHash)
+	}
+
+	_, err = FetchMetadata([]peer.Peer{liar.peer()}, infoHash, [20]byte{'t'}, testMetadataConfig())
+	if !errors.Is(err, ErrMetadataMismatch) {
+		t.Errorf("got %v, want ErrMetadataMismatch", err)
+	}
+}
@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"bitTorrent/peer"
+)
+
+type Metrics struct {
+	HandshakeTimeouts  int64
+	HandshakeRefused   int64
+	HandshakeTruncated int64
+	InfoHashMismatches int64
+	BadBitfields       int64
+	HandshakeOther     int64
+	PeersConnected     int64
+	// Wire bytes across every peer connection of the download
+	BytesDownloaded int64
+	BytesUploaded   int64
+}
+
+type metrics struct {
+	handshakeTimeouts  atomic.Int64
+	handshakeRefused   atomic.Int64
+	handshakeTruncated atomic.Int64
+	infoHashMismatches atomic.Int64
+	badBitfields       atomic.Int64
+	handshakeOther     atomic.Int64
+	peersConnected     atomic.Int64
+	traffic            peer.Traffic
+}
+
+func (m *metrics) recordHandshakeFailure(err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, peer.ErrBadBitfield):
+		m.badBitfields.Add(1)
+	case errors.Is(err, peer.ErrInfoHashMismatch):
+		m.infoHashMismatches.Add(1)
+	case errors.Is(err, peer.ErrHandshakeTruncated), errors.Is(err, peer.ErrInvalidPstrlen):
+		m.handshakeTruncated.Add(1)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		m.handshakeRefused.Add(1)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		m.handshakeTimeouts.Add(1)
+	default:
+		m.handshakeOther.Add(1)
+	}
+}
+
+func (t *Torrent) Metrics() Metrics {
+	return Metrics{
+		HandshakeTimeouts:  t.metrics.handshakeTimeouts.Load(),
+		HandshakeRefused:   t.metrics.handshakeRefused.Load(),
+		HandshakeTruncated: t.metrics.handshakeTruncated.Load(),
+		InfoHashMismatches: t.metrics.infoHashMismatches.Load(),
+		BadBitfields:       t.metrics.badBitfields.Load(),
+		HandshakeOther:     t.metrics.handshakeOther.Load(),
+		PeersConnected:     t.metrics.peersConnected.Load(),
+		BytesDownloaded:    t.metrics.traffic.Downloaded.Load(),
+		BytesUploaded:      t.metrics.traffic.Uploaded.Load(),
+	}
+}
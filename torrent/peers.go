@@ -0,0 +1,121 @@
+package torrent
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bitTorrent/helpers/bitfield"
+	"bitTorrent/peer"
+)
+
+// What we know about one connected peer, the counters are written by its worker
+type connectedPeer struct {
+	peer       peer.Peer
+	client     *peer.Client
+	since      time.Time
+	choked     atomic.Bool
+	downloaded atomic.Int64
+	// Set once our bitfield went out, Haves sent before it would break the protocol
+	announced atomic.Bool
+
+	// Only the worker writes client.Bitfield, it takes mu so PeerBitfields can copy it
+	mu sync.Mutex
+}
+
+// Marks a piece from a Have, reports whether the bit was new
+func (cp *connectedPeer) setPiece(index int) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.client.Bitfield.SetPiece(index)
+}
+
+func (t *Torrent) trackPeer(p peer.Peer, client *peer.Client) *connectedPeer {
+	cp := &connectedPeer{peer: p, client: client, since: time.Now()}
+	cp.choked.Store(client.Choked)
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	if t.connected == nil {
+		t.connected = map[string]*connectedPeer{}
+	}
+	t.connected[p.String()] = cp
+	return cp
+}
+
+func (t *Torrent) untrackPeer(p peer.Peer) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	delete(t.connected, p.String())
+}
+
+// Tells a new peer which pieces we have, including those from before this session.
+// The bitfield is copied and sent without holding completedMu, a slow peer must not
+// hold up markCompleted. Pieces finishing meanwhile are sent as Haves afterwards.
+func (t *Torrent) sendBitfield(cp *connectedPeer) {
+	t.completedMu.Lock()
+	have := append(bitfield.Bitfield(nil), t.completed...)
+	t.completedMu.Unlock()
+	have.ClearSpare(len(t.PieceHashes))
+	// An empty bitfield may be left out altogether
+	if slices.ContainsFunc(have, func(b byte) bool { return b != 0 }) {
+		cp.client.SendBitfield(have)
+	}
+	cp.announced.Store(true)
+
+	// broadcastHave skipped this peer until announced was set, anything it skipped
+	// was marked complete before that and so shows up here
+	var missed []int
+	t.completedMu.Lock()
+	for index := range t.PieceHashes {
+		if t.completed.CheckPiece(index) && !have.CheckPiece(index) {
+			missed = append(missed, index)
+		}
+	}
+	t.completedMu.Unlock()
+	for _, index := range missed {
+		cp.client.SendHave(index)
+	}
+}
+
+// Sends Have for a newly verified piece to every connected peer that already got our
+// bitfield, not just the one it came from. Peers that are known to hold it already
+// are skipped, they have no use for it.
+func (t *Torrent) broadcastHave(index int) {
+	t.peersMu.Lock()
+	peers := make([]*connectedPeer, 0, len(t.connected))
+	for _, cp := range t.connected {
+		peers = append(peers, cp)
+	}
+	t.peersMu.Unlock()
+
+	// Sent without peersMu so one slow peer does not hold up workers connecting or leaving
+	for _, cp := range peers {
+		if !cp.announced.Load() || cp.hasPiece(index) {
+			continue
+		}
+		if err := cp.client.SendHave(index); err != nil {
+			debugLog.Printf("Could Not Send Have %d To %s: %v", index, cp.peer, err)
+		}
+	}
+}
+
+func (cp *connectedPeer) hasPiece(index int) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.client.Bitfield.CheckPiece(index)
+}
+
+// Snapshot of what every connected peer has, keyed by address. Handy to find out
+// why a piece never downloads, usually no connected peer has it.
+func (t *Torrent) PeerBitfields() map[string]bitfield.Bitfield {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	bitfields := make(map[string]bitfield.Bitfield, len(t.connected))
+	for addr, cp := range t.connected {
+		cp.mu.Lock()
+		bitfields[addr] = append(bitfield.Bitfield(nil), cp.client.Bitfield...)
+		cp.mu.Unlock()
+	}
+	return bitfields
+}
@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"bitTorrent/helpers/bitfield"
+	"bitTorrent/message"
+	"bitTorrent/peer"
+)
+
+// A peerSession reading from the returned conn, as if a peer with an empty bitfield had connected
+func newTestSession(t *testing.T, picker *piecePicker, numPieces int) (*peerSession, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	client := &peer.Client{Conn: local, Bitfield: make(bitfield.Bitfield, (numPieces+7)/8)}
+	cp := &connectedPeer{client: client}
+	return &peerSession{conn: cp, client: client, picker: picker, config: DefaultConfig()}, remote
+}
+
+func haveMessage(index int) *message.Message {
+	return &message.Message{ID: message.MsgHave, Payload: []byte{0, 0, 0, byte(index)}}
+}
+
+func TestDuplicateHaveCountsOnce(t *testing.T) {
+	picker := newPiecePicker(nil, 4, RarestFirst{}, 0)
+	s, remote := newTestSession(t, picker, 4)
+	go func() {
+		for range 3 {
+			remote.Write(haveMessage(2).Serialize())
+		}
+	}()
+	for range 3 {
+		if _, err := s.checkState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := picker.availability[2]; got != 1 {
+		t.Fatalf("availability of piece 2 is %d after three Haves from one peer, want 1", got)
+	}
+	picker.removePeer(s.client.Bitfield)
+	if got := picker.availability[2]; got != 0 {
+		t.Errorf("availability of piece 2 is %d after the peer left, want 0", got)
+	}
+}
+
+func TestSlowPeerDoesNotBlockCompletion(t *testing.T) {
+	tor := &Torrent{PieceHashes: make([][20]byte, 4)}
+	tor.initCompleted()
+	tor.markCompleted(0)
+
+	// Writes to a pipe block until the other end reads, like a peer that stopped reading
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	client := &peer.Client{Conn: local, Bitfield: make(bitfield.Bitfield, 1)}
+	cp := tor.trackPeer(peer.NewPeer(net.IP{127, 0, 0, 1}, 6881), client)
+	go tor.sendBitfield(cp)
+
+	done := make(chan struct{})
+	go func() {
+		tor.markCompleted(1)
+		tor.broadcastHave(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("completing a piece blocked behind a peer that is not reading")
+	}
+
+	// Whichever way it raced, the peer has to learn about both pieces
+	have := make(bitfield.Bitfield, 1)
+	remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		msg, err := message.ReadMessage(remote)
+		if err != nil {
+			break
+		}
+		switch {
+		case msg.ID == message.MsgBitField:
+			have[0] |= msg.Payload[0]
+		case msg.ID == message.MsgHave:
+			index, _ := msg.AsHave()
+			have.SetPiece(index)
+		}
+	}
+	if !have.CheckPiece(0) || !have.CheckPiece(1) || have.CheckPiece(2) {
+		t.Errorf("peer was told about %08b, want pieces 0 and 1", have[0])
+	}
+}
@@ -0,0 +1,152 @@
+package torrent
+
+import (
+	"sync"
+
+	"bitTorrent/helpers/bitfield"
+)
+
+// Hands out pieces to workers in the order the strategy chooses
+type piecePicker struct {
+	mu           sync.Mutex
+	work         []*pieceWork // by index, nil for pieces we already had
+	wanted       bitfield.Bitfield
+	availability []int
+	strategy     PieceStrategy
+	closed       bool
+	// Pieces handed out and not yet released, capped at maxActive to bound piece buffers in memory.
+	// A downloaded piece is only released once it is written or fails its hash check
+	active    int
+	maxActive int
+}
+
+func newPiecePicker(work []*pieceWork, numPieces int, strategy PieceStrategy, maxActive int) *piecePicker {
+	pp := &piecePicker{
+		work:         make([]*pieceWork, numPieces),
+		wanted:       make(bitfield.Bitfield, (numPieces+7)/8),
+		availability: make([]int, numPieces),
+		strategy:     strategy,
+		maxActive:    maxActive,
+	}
+	for _, pw := range work {
+		pp.work[pw.index] = pw
+		pp.wanted.SetPiece(pw.index)
+	}
+	return pp
+}
+
+// Counts every piece in a newly connected peer's bitfield
+func (pp *piecePicker) addPeer(bf bitfield.Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for index := range pp.availability {
+		if bf.CheckPiece(index) {
+			pp.availability[index]++
+		}
+	}
+}
+
+// Undoes addPeer and every Have the peer sent so counts only reflect connected peers
+func (pp *piecePicker) removePeer(bf bitfield.Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for index := range pp.availability {
+		if bf.CheckPiece(index) && pp.availability[index] > 0 {
+			pp.availability[index]--
+		}
+	}
+}
+
+// Number of pending pieces no connected peer has, a download can not finish while this is above zero
+func (pp *piecePicker) unavailable() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	missing := 0
+	for index, count := range pp.availability {
+		if count == 0 && pp.wanted.CheckPiece(index) {
+			missing++
+		}
+	}
+	return missing
+}
+
+// Only call this when the peer's bit actually flipped so duplicate Haves are not counted twice
+func (pp *piecePicker) addAvailability(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if index >= 0 && index < len(pp.availability) {
+		pp.availability[index]++
+	}
+}
+
+// Never blocks. A nil piece with wanted true means the peer has pieces we need but
+// MaxActivePieces is reached, so it is still worth staying interested in.
+func (pp *piecePicker) tryNext(bf bitfield.Bitfield) (pw *pieceWork, wanted bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.closed {
+		return nil, false
+	}
+	if pp.maxActive > 0 && pp.active >= pp.maxActive {
+		return nil, pp.hasWanted(bf)
+	}
+	pw = pp.pick(bf)
+	if pw != nil {
+		pp.active++
+	}
+	return pw, pw != nil
+}
+
+func (pp *piecePicker) hasWanted(bf bitfield.Bitfield) bool {
+	for i := range min(len(pp.wanted), len(bf)) {
+		if pp.wanted[i]&bf[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Frees the slot a piece took in tryNext, once it is downloaded or given back
+func (pp *piecePicker) release() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.active--
+}
+
+// Pieces handed out that are still being downloaded, verified or written
+func (pp *piecePicker) inFlight() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.active
+}
+
+func (pp *piecePicker) pick(bf bitfield.Bitfield) *pieceWork {
+	index, ok := pp.strategy.Next(pp.availability, pp.wanted, bf)
+	// A custom strategy can get it wrong, never hand out a piece twice
+	if !ok || !pp.wanted.CheckPiece(index) || !bf.CheckPiece(index) {
+		return nil
+	}
+	pp.wanted.ClearPiece(index)
+	return pp.work[index]
+}
+
+func (pp *piecePicker) requeue(pw *pieceWork) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.closed {
+		return
+	}
+	pp.wanted.SetPiece(pw.index)
+}
+
+func (pp *piecePicker) isClosed() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.closed
+}
+
+func (pp *piecePicker) close() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.closed = true
+}
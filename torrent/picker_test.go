@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitTorrent/helpers/bitfield"
+)
+
+func testWork(numPieces int) []*pieceWork {
+	work := make([]*pieceWork, numPieces)
+	for index := range work {
+		work[index] = &pieceWork{index: index, length: 1}
+	}
+	return work
+}
+
+func fullBitfield(numPieces int) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, (numPieces+7)/8)
+	for index := range numPieces {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+func TestTryNextAtMaxActivePieces(t *testing.T) {
+	picker := newPiecePicker(testWork(4), 4, Sequential{}, 1)
+	all := fullBitfield(4)
+
+	pw, wanted := picker.tryNext(all)
+	if pw == nil || !wanted {
+		t.Fatalf("got %v, %t, want the first piece", pw, wanted)
+	}
+	// The cap is reached, the peer still has pieces we need
+	pw, wanted = picker.tryNext(all)
+	if pw != nil || !wanted {
+		t.Errorf("at the cap got %v, %t, want nil, true", pw, wanted)
+	}
+	// A peer with only the piece already handed out has nothing for us
+	only0 := make(bitfield.Bitfield, 1)
+	only0.SetPiece(0)
+	pw, wanted = picker.tryNext(only0)
+	if pw != nil || wanted {
+		t.Errorf("for a peer with nothing wanted got %v, %t, want nil, false", pw, wanted)
+	}
+
+	picker.release()
+	pw, wanted = picker.tryNext(all)
+	if pw == nil || pw.index != 1 || !wanted {
+		t.Errorf("after release got %v, %t, want piece 1", pw, wanted)
+	}
+}
+
+// Many workers handing pieces back far more often than there are pieces. Run with -race.
+func TestPickerConcurrentRequeues(t *testing.T) {
+	const numPieces = 64
+	const workers = 16
+	picker := newPiecePicker(testWork(numPieces), numPieces, RarestFirst{}, 8)
+	all := fullBitfield(numPieces)
+	picker.addPeer(all)
+
+	var mu sync.Mutex
+	completed := map[int]int{}
+	var requeues atomic.Int64
+	var wg sync.WaitGroup
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attempt := worker; ; {
+				mu.Lock()
+				finished := len(completed) == numPieces
+				mu.Unlock()
+				if finished {
+					return
+				}
+				pw, _ := picker.tryNext(all)
+				if pw == nil {
+					runtime.Gosched()
+					continue
+				}
+				attempt++
+				// Four out of five attempts fail and go back, like a peer dropping mid piece
+				if attempt%5 != 0 {
+					picker.requeue(pw)
+					picker.release()
+					requeues.Add(1)
+					continue
+				}
+				mu.Lock()
+				completed[pw.index]++
+				mu.Unlock()
+				picker.release()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("workers deadlocked")
+	}
+	if requeues.Load() < 2*numPieces {
+		t.Errorf("only %d requeues, the test did not stress anything", requeues.Load())
+	}
+	for index := range numPieces {
+		if completed[index] != 1 {
+			t.Errorf("piece %d completed %d times", index, completed[index])
+		}
+	}
+	if picker.inFlight() != 0 {
+		t.Errorf("%d pieces still in flight", picker.inFlight())
+	}
+
+	// Late workers giving pieces back after the download ended must not panic or block
+	picker.close()
+	picker.requeue(picker.work[0])
+	if pw, _ := picker.tryNext(all); pw != nil {
+		t.Errorf("closed picker handed out piece %d", pw.index)
+	}
+}
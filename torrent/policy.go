@@ -0,0 +1,54 @@
+package torrent
+
+// Which peer sources a torrent may use once Config and the private flag are both taken into account
+type Discovery struct {
+	Trackers bool
+	DHT      bool
+	PEX      bool
+	LSD      bool
+}
+
+// Private torrents (BEP27) only ever talk to their trackers, whatever Config asks for.
+// A public torrent without any tracker has nothing but DHT so it is switched on.
+func (t *Torrent) Discovery() Discovery {
+	if t.Private {
+		return Discovery{Trackers: t.HasTrackers()}
+	}
+	d := Discovery{
+		Trackers: t.HasTrackers(),
+		DHT:      t.Config.DHT,
+		PEX:      t.Config.PEX,
+		LSD:      t.Config.LSD,
+	}
+	if !d.Trackers {
+		d.DHT = true
+	}
+	return d
+}
+
+// Handshake capability bits (BEP4) for the features we use
+const (
+	reservedExtension = 0x10 // byte 5, BEP10 extension protocol
+	reservedDHT       = 0x01 // byte 7, BEP5
+)
+
+// The capability bits for our handshake. Config.Reserved is sent as is when set, otherwise
+// a bit is only claimed for a feature that is switched on since peers act on what we claim
+func (t *Torrent) reserved() [8]byte {
+	reserved := t.Config.Reserved
+	d := t.Discovery()
+	if reserved == [8]byte{} {
+		// PEX runs over extension messages and yourip comes in the extended handshake
+		if d.PEX || t.Config.OnExternalIP != nil {
+			reserved[5] |= reservedExtension
+		}
+		if d.DHT {
+			reserved[7] |= reservedDHT
+		}
+	}
+	if !d.DHT {
+		// Do not advertise a DHT we are not allowed to use, private trackers ban for it
+		reserved[7] &^= reservedDHT
+	}
+	return reserved
+}
@@ -0,0 +1,64 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDiscovery(t *testing.T) {
+	tests := []struct {
+		name string
+		tf   TorrentFile
+		dht  bool
+		want Discovery
+	}{
+		{"announce", TorrentFile{Announce: "http://a/announce"}, false, Discovery{Trackers: true}},
+		{"announce-list only", TorrentFile{AnnounceList: [][]string{{"http://a/announce"}}}, false, Discovery{Trackers: true}},
+		{"trackerless", TorrentFile{}, false, Discovery{DHT: true}},
+		{"public with DHT", TorrentFile{Announce: "http://a/announce"}, true, Discovery{Trackers: true, DHT: true}},
+		{"private announce-list only", TorrentFile{AnnounceList: [][]string{{"http://a/announce"}}, Private: true}, true, Discovery{Trackers: true}},
+		{"private trackerless", TorrentFile{Private: true}, true, Discovery{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := tt.tf.ToTorrent(nil, [20]byte{})
+			tor.Config.DHT = tt.dht
+			if got := tor.Discovery(); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if tor.HasTrackers() != tt.tf.HasTrackers() {
+				t.Errorf("Torrent.HasTrackers %t, TorrentFile.HasTrackers %t", tor.HasTrackers(), tt.tf.HasTrackers())
+			}
+		})
+	}
+}
+
+func TestReserved(t *testing.T) {
+	public := TorrentFile{Announce: "http://a/announce"}
+	private := TorrentFile{Announce: "http://a/announce", Private: true}
+	tests := []struct {
+		name string
+		tf   TorrentFile
+		set  func(*Config)
+		want [8]byte
+	}{
+		{"nothing on", public, func(c *Config) {}, [8]byte{}},
+		{"DHT", public, func(c *Config) { c.DHT = true }, [8]byte{7: 0x01}},
+		{"trackerless", TorrentFile{}, func(c *Config) {}, [8]byte{7: 0x01}},
+		{"PEX", public, func(c *Config) { c.PEX = true }, [8]byte{5: 0x10}},
+		{"external IP", public, func(c *Config) { c.OnExternalIP = func(net.IP) {} }, [8]byte{5: 0x10}},
+		{"private", private, func(c *Config) { c.DHT, c.PEX = true, true }, [8]byte{}},
+		{"override", public, func(c *Config) { c.Reserved, c.DHT = [8]byte{5: 0x10, 7: 0x05}, true }, [8]byte{5: 0x10, 7: 0x05}},
+		{"override without DHT", public, func(c *Config) { c.Reserved = [8]byte{5: 0x10, 7: 0x05} }, [8]byte{5: 0x10, 7: 0x04}},
+		{"override on private", private, func(c *Config) { c.Reserved = [8]byte{5: 0x10, 7: 0x05} }, [8]byte{5: 0x10, 7: 0x04}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := tt.tf.ToTorrent(nil, [20]byte{})
+			tt.set(&tor.Config)
+			if got := tor.reserved(); got != tt.want {
+				t.Errorf("got %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package torrent
+
+import "bitTorrent/helpers/bitfield"
+
+func (t *Torrent) resetCompleted() {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	t.completed = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+}
+
+// Like resetCompleted but keeps pieces that are already marked
+func (t *Torrent) initCompleted() {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	if t.completed == nil {
+		t.completed = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	}
+}
+
+func (t *Torrent) markCompleted(index int) {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	t.completed.SetPiece(index)
+}
+
+// Number of bytes from the start of the torrent that are verified with no gaps,
+// useful for serving a growing prefix while a SequentialDownload is running
+func (t *Torrent) ContiguousLength() int {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	if t.completed == nil {
+		return 0
+	}
+	pieces := 0
+	for pieces < len(t.PieceHashes) && t.completed.CheckPiece(pieces) {
+		pieces++
+	}
+	return min(pieces*t.PieceLength, t.Length)
+}
+
+// A copy of the verified pieces, safe to call while the download is running
+func (t *Torrent) CompletedBitfield() bitfield.Bitfield {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	if t.completed == nil {
+		return make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	}
+	return append(bitfield.Bitfield(nil), t.completed...)
+}
+
+// Indices of the pieces not verified yet, in ascending order. Safe to call while downloading.
+func (t *Torrent) MissingPieces() []int {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	missing := []int{}
+	for index := range t.PieceHashes {
+		if !t.completed.CheckPiece(index) {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+func (t *Torrent) IsPieceComplete(index int) bool {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	return t.completed.CheckPiece(index)
+}
+
+// Every piece but the last is PieceLength long so only the last one needs a lookup
+func (t *Torrent) bytesCompleted(pieces int) int {
+	n := pieces * t.PieceLength
+	last := len(t.PieceHashes) - 1
+	if last >= 0 && t.IsPieceComplete(last) {
+		n -= t.PieceLength - t.CalculateLengthForPiece(last)
+	}
+	return n
+}
+
+func (t *Torrent) Progress() (done int, total int) {
+	t.completedMu.Lock()
+	defer t.completedMu.Unlock()
+	for index := range t.PieceHashes {
+		if t.completed.CheckPiece(index) {
+			done++
+		}
+	}
+	return done, len(t.PieceHashes)
+}
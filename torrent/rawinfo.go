@@ -0,0 +1,88 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var errNoInfoDict = errors.New("torrent has no info dictionary")
+
+// Returns the exact bytes of the top level "info" value. The infohash has to be
+// taken over these and not over a re-encoding, which would drop unknown keys
+// and fix up any non canonical encoding the creator used.
+func extractInfoDict(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || raw[0] != 'd' {
+		return nil, fmt.Errorf("torrent is not a bencoded dictionary")
+	}
+	pos := 1
+	for pos < len(raw) && raw[pos] != 'e' {
+		keyEnd, err := skipValue(raw, pos)
+		if err != nil {
+			return nil, err
+		}
+		if raw[pos] < '0' || raw[pos] > '9' {
+			return nil, fmt.Errorf("dictionary key at offset %d is not a string", pos)
+		}
+		key := raw[bytes.IndexByte(raw[pos:], ':')+pos+1 : keyEnd]
+		valueEnd, err := skipValue(raw, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if string(key) == "info" {
+			return raw[keyEnd:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+	return nil, errNoInfoDict
+}
+
+// Returns the offset just past the bencoded value starting at pos
+func skipValue(raw []byte, pos int) (int, error) {
+	if pos >= len(raw) {
+		return 0, fmt.Errorf("bencode truncated at offset %d", pos)
+	}
+	switch c := raw[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(raw[pos:], 'e')
+		if end == -1 {
+			return 0, fmt.Errorf("unterminated integer at offset %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(raw) && raw[pos] != 'e' {
+			next, err := skipValue(raw, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(raw) {
+			return 0, fmt.Errorf("unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(raw[pos:], ':')
+		if colon == -1 {
+			return 0, fmt.Errorf("string length at offset %d has no colon", pos)
+		}
+		length := 0
+		for _, d := range raw[pos : pos+colon] {
+			if d < '0' || d > '9' {
+				return 0, fmt.Errorf("bad string length at offset %d", pos)
+			}
+			length = length*10 + int(d-'0')
+			if length > len(raw) {
+				return 0, fmt.Errorf("string at offset %d runs past the end", pos)
+			}
+		}
+		end := pos + colon + 1 + length
+		if end > len(raw) {
+			return 0, fmt.Errorf("string at offset %d runs past the end", pos)
+		}
+		return end, nil
+	default:
+		return 0, fmt.Errorf("unexpected byte %q at offset %d", c, pos)
+	}
+}
@@ -0,0 +1,52 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Re-reads and hashes every piece from r, rebuilding the completed bitfield from scratch.
+// Config.VerifyWorkers goroutines share the work, r has to allow concurrent ReadAt calls
+// like os.File and Storage do.
+func (t *Torrent) Recheck(r io.ReaderAt) (passed int, failed int, err error) {
+	t.resetCompleted()
+	var next, passedCount, failedCount atomic.Int64
+	var errOnce sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for range max(t.Config.VerifyWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, t.PieceLength)
+			for {
+				index := int(next.Add(1) - 1)
+				if index >= len(t.PieceHashes) {
+					return
+				}
+				begin, end := t.CalculateBoundsForPiece(index)
+				piece := buf[:end-begin]
+				_, err := r.ReadAt(piece, int64(begin))
+				if err != nil && err != io.EOF {
+					errOnce.Do(func() { firstErr = err })
+					// Pushes the shared cursor past the end so the other workers stop too
+					next.Store(int64(len(t.PieceHashes)))
+					return
+				}
+				if err == nil && sha1.Sum(piece) == t.PieceHashes[index] {
+					t.markCompleted(index)
+					passedCount.Add(1)
+				} else {
+					failedCount.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if s, ok := r.(*Storage); ok && firstErr == nil {
+		s.markVerified()
+	}
+	return int(passedCount.Load()), int(failedCount.Load()), firstErr
+}
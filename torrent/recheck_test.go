@@ -0,0 +1,26 @@
+package torrent
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Rechecks 16 MiB held in memory, once per worker count
+func BenchmarkRecheck(b *testing.B) {
+	const pieceLength = 256 * 1024
+	data := testData(64 * pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tor.Config.VerifyWorkers = workers
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				passed, failed, err := tor.Recheck(memoryWriter(data))
+				if err != nil || passed != len(tor.PieceHashes) || failed != 0 {
+					b.Fatalf("got %d passed, %d failed, %v", passed, failed, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+
+	"github.com/jackpal/bencode-go"
+
+	"bitTorrent/helpers/bitfield"
+)
+
+var ErrResumeInvalid = errors.New("resume file does not match the data on disk")
+
+// Number of pieces LoadResume hashes again before trusting the saved bitfield
+const resumeSpotChecks = 4
+
+type resumeFile struct {
+	InfoHash   string        `bencode:"info-hash"`
+	Pieces     string        `bencode:"pieces"`
+	Downloaded int64         `bencode:"downloaded"`
+	Uploaded   int64         `bencode:"uploaded"`
+	Files      []resumeStamp `bencode:"files"`
+}
+
+// Size and modification time of a file, if either changed since the save the bitfield is not trusted
+type resumeStamp struct {
+	Size  int64 `bencode:"size"`
+	MTime int64 `bencode:"mtime"`
+}
+
+// Records the verified pieces together with the state of the files in s so a
+// restart can skip hashing everything again
+func (t *Torrent) SaveResume(path string, s *Storage) error {
+	completed := t.CompletedBitfield()
+	done, _ := t.Progress()
+	// Stamps are taken after the flush so they describe what is really on disk
+	err := s.Flush()
+	if err != nil {
+		return err
+	}
+	stamps, err := s.stamps()
+	if err != nil {
+		return err
+	}
+	state := resumeFile{
+		InfoHash:   string(t.InfoHash[:]),
+		Pieces:     string(completed),
+		Downloaded: int64(t.bytesCompleted(done)),
+		Files:      stamps,
+	}
+	var buffer bytes.Buffer
+	err = bencode.Marshal(&buffer, state)
+	if err != nil {
+		return err
+	}
+	// Written next to the target and renamed so a crash never leaves half a resume file
+	err = os.WriteFile(path+".tmp", buffer.Bytes(), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Restores the completed pieces saved by SaveResume. Any mismatch with the torrent
+// or the files in s returns an error and the caller should fall back to Recheck.
+func (t *Torrent) LoadResume(path string, s *Storage) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var state resumeFile
+	err = bencode.Unmarshal(file, &state)
+	if err != nil {
+		return err
+	}
+	if state.InfoHash != string(t.InfoHash[:]) {
+		return fmt.Errorf("%w: it is for another torrent", ErrResumeInvalid)
+	}
+	completed := bitfield.Bitfield(state.Pieces)
+	if len(completed) != (len(t.PieceHashes)+7)/8 {
+		return fmt.Errorf("%w: bitfield is %d bytes", ErrResumeInvalid, len(completed))
+	}
+	stamps, err := s.stamps()
+	if err != nil {
+		return err
+	}
+	if len(stamps) != len(state.Files) {
+		return fmt.Errorf("%w: file count changed", ErrResumeInvalid)
+	}
+	for i := range stamps {
+		if stamps[i] != state.Files[i] {
+			return fmt.Errorf("%w: file %d was modified", ErrResumeInvalid, i)
+		}
+	}
+
+	var have []int
+	for index := range t.PieceHashes {
+		if completed.CheckPiece(index) {
+			have = append(have, index)
+		}
+	}
+	buf := make([]byte, t.PieceLength)
+	for range min(resumeSpotChecks, len(have)) {
+		index := have[rand.IntN(len(have))]
+		piece := buf[:t.CalculateLengthForPiece(index)]
+		begin, _ := t.CalculateBoundsForPiece(index)
+		_, err := s.ReadAt(piece, int64(begin))
+		if err != nil || sha1.Sum(piece) != t.PieceHashes[index] {
+			return fmt.Errorf("%w: piece %d failed its spot check", ErrResumeInvalid, index)
+		}
+	}
+
+	t.resetCompleted()
+	for _, index := range have {
+		t.markCompleted(index)
+	}
+	s.markVerified()
+	return nil
+}
@@ -0,0 +1,316 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"bitTorrent/message"
+	"bitTorrent/peer"
+)
+
+type pieceProgress struct {
+	work       *pieceWork
+	buffer     []byte
+	downloaded int
+	requested  int
+	pending    map[int]int
+	received   []bool // indexed by block, begin / blockSize
+	blockSize  int
+	started    time.Time
+	firstBlock time.Time
+}
+
+// Every piece one worker is fetching from its peer. Block requests are
+// interleaved across them so a single fast seed always has work queued.
+type peerSession struct {
+	conn    *connectedPeer
+	client  *peer.Client
+	picker  *piecePicker
+	config  Config
+	active  []*pieceProgress
+	backlog int
+}
+
+func newPieceProgress(pw *pieceWork, blockSize int) *pieceProgress {
+	state := &pieceProgress{
+		work:      pw,
+		pending:   map[int]int{},
+		blockSize: blockSize,
+		started:   time.Now(),
+	}
+	if pw.partial != nil {
+		state.buffer, state.received = pw.partial, pw.received
+		pw.partial, pw.received = nil, nil
+		for block, ok := range state.received {
+			if ok {
+				state.downloaded += state.blockLength(block * blockSize)
+			}
+		}
+		state.skipReceived()
+		return state
+	}
+	state.buffer = make([]byte, pw.length)
+	state.received = make([]bool, (pw.length+blockSize-1)/blockSize)
+	return state
+}
+
+// Size of the block starting at begin, only the last block of a piece is short.
+// Zero once begin reaches the end so callers never ask for an empty or negative block.
+func (state *pieceProgress) blockLength(begin int) int {
+	return max(min(state.blockSize, state.work.length-begin), 0)
+}
+
+// Moves the request cursor past blocks we already hold
+func (state *pieceProgress) skipReceived() {
+	for state.requested < state.work.length && state.received[state.requested/state.blockSize] {
+		state.requested += state.blockSize
+	}
+}
+
+func (s *peerSession) find(index int) *pieceProgress {
+	for _, state := range s.active {
+		if state.work.index == index {
+			return state
+		}
+	}
+	return nil
+}
+
+func (s *peerSession) remove(state *pieceProgress) {
+	for i, active := range s.active {
+		if active == state {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// How often an idle worker looks at the picker again while it listens for Haves
+const idlePollInterval = 2 * time.Second
+
+// Tops up the active pieces, reports false once the picker is closed and nothing is left to do
+func (s *peerSession) fill(maxActive int) (bool, error) {
+	if len(s.active) == 0 {
+		pw, err := s.waitForWork()
+		if pw == nil {
+			return false, err
+		}
+		s.active = append(s.active, newPieceProgress(pw, s.config.blockSize()))
+	}
+	for len(s.active) < maxActive {
+		pw, _ := s.picker.tryNext(s.client.Bitfield)
+		if pw == nil {
+			break
+		}
+		s.active = append(s.active, newPieceProgress(pw, s.config.blockSize()))
+	}
+	return true, nil
+}
+
+// Waits for a piece this peer has without spinning. Unless we are only held back by
+// MaxActivePieces the peer is told we are not interested meanwhile, and its Haves keep
+// being read so a piece it gets later (or one another worker gives back) is picked up.
+func (s *peerSession) waitForWork() (*pieceWork, error) {
+	interested := true
+	for !s.picker.isClosed() {
+		pw, wanted := s.picker.tryNext(s.client.Bitfield)
+		if pw != nil {
+			if !interested {
+				s.client.SendInterested()
+			}
+			return pw, nil
+		}
+		if wanted != interested {
+			if wanted {
+				s.client.SendInterested()
+			} else {
+				s.client.SendNotInterested()
+			}
+			interested = wanted
+		}
+		// Only small messages (have, choke, keep alive) are expected here so a read
+		// cut short by the deadline will not leave us in the middle of one
+		s.client.Conn.SetReadDeadline(time.Now().Add(idlePollInterval))
+		_, err := s.checkState()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Hands out one block per piece in turn until the backlog is full or every block is requested
+func (s *peerSession) requestBlocks() error {
+	for s.backlog < MAXBACKLOG {
+		requested := false
+		for _, state := range s.active {
+			if s.backlog >= MAXBACKLOG || state.requested >= state.work.length {
+				continue
+			}
+			blockSize := state.blockLength(state.requested)
+			if blockSize == 0 {
+				continue
+			}
+
+			err := s.client.SendRequest(state.work.index, state.requested, blockSize)
+			if err != nil {
+				return err
+			}
+
+			state.pending[state.requested] = blockSize
+			s.backlog++
+			state.requested += blockSize
+			state.skipReceived()
+			requested = true
+		}
+		if !requested {
+			break
+		}
+	}
+	return nil
+}
+
+// Reads one message and returns the piece it completed, if any
+func (s *peerSession) checkState() (*pieceProgress, error) {
+	msg, err := s.client.Read()
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, nil
+	}
+	switch msg.ID {
+	case message.MsgUnchoke:
+		s.client.Choked = false
+		s.conn.choked.Store(false)
+	case message.MsgChoke:
+		s.client.Choked = true
+		s.conn.choked.Store(true)
+		s.resetRequests()
+	case message.MsgExtended:
+		if len(msg.Payload) > 0 && msg.Payload[0] == 0 {
+			s.config.handleExtendedHandshake(s.client, msg.Payload[1:])
+		}
+	case message.MsgHave:
+		index, err := message.ParseHaveMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		if s.conn.setPiece(index) {
+			s.picker.addAvailability(index)
+		}
+	case message.MsgPiece:
+		index, begin, data, ok := msg.AsPiece()
+		if !ok {
+			return nil, fmt.Errorf("Piece Message Of %d Bytes Is Too Short For Index And Begin", len(msg.Payload))
+		}
+		state := s.find(index)
+		if state == nil {
+			// Usually a late block of a piece we already gave up on, not worth dropping the peer over
+			debugLog.Printf("Ignoring Block Of Piece %d Which We Are Not Downloading", index)
+			return nil, nil
+		}
+		length, ok := state.pending[begin]
+		if !ok {
+			// Duplicate or a block we cancelled, it must not count towards the piece twice
+			return nil, nil
+		}
+		// Pending blocks were requested inside the piece so the length check is all the bounds checking needed
+		n := len(data)
+		if n != length {
+			return nil, fmt.Errorf("Block %d of Piece %d is %d bytes, asked for %d", begin, index, n, length)
+		}
+		copy(state.buffer[begin:], data)
+		if state.firstBlock.IsZero() {
+			state.firstBlock = time.Now()
+		}
+		delete(state.pending, begin)
+		state.received[begin/state.blockSize] = true
+		state.downloaded += n
+		s.conn.downloaded.Add(int64(n))
+		s.backlog--
+		if state.downloaded >= state.work.length {
+			return state, nil
+		}
+	}
+	return nil, nil
+}
+
+// A choke drops everything we asked for (BEP3), so the blocks still pending are
+// forgotten and asked for again once we are unchoked
+func (s *peerSession) resetRequests() {
+	for _, state := range s.active {
+		state.pending = map[int]int{}
+		state.requested = 0
+		state.skipReceived()
+	}
+	s.backlog = 0
+}
+
+// Gives every unfinished piece back to the picker so other workers can take it,
+// blocks that already arrived travel with it and are not requested again. Nothing
+// is cancelled, the connection is closed right after and the peer drops our requests with it
+func (s *peerSession) abort() {
+	for _, state := range s.active {
+		if state.downloaded > 0 {
+			state.work.partial, state.work.received = state.buffer, state.received
+		}
+		s.picker.requeue(state.work)
+		s.picker.release()
+	}
+	s.active = nil
+}
+
+// Downloads from one connected peer until the picker closes (nil) or the connection fails
+func (t *Torrent) downloadFromPeer(conn *connectedPeer, sw *swarm) error {
+	client, picker := conn.client, sw.picker
+	s := &peerSession{conn: conn, client: client, picker: picker, config: t.Config}
+	defer client.Conn.SetDeadline(time.Time{})
+
+	maxActive := max(t.Config.MaxPiecesPerPeer, 1)
+	for {
+		ok, err := s.fill(maxActive)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		// Sliding deadline, only a peer that goes quiet for the idle timeout gets dropped
+		client.Conn.SetDeadline(time.Now().Add(t.Config.PieceIdleTimeout))
+
+		if !client.Choked {
+			err := s.requestBlocks()
+			if err != nil {
+				s.abort()
+				return err
+			}
+		}
+
+		state, err := s.checkState()
+		if err != nil {
+			s.abort()
+			return err
+		}
+		if state == nil {
+			continue
+		}
+
+		s.remove(state)
+		debugLog.Printf("Piece %d from %s: first block after %s, done in %s",
+			state.work.index, client.Conn.RemoteAddr(), state.firstBlock.Sub(state.started), time.Since(state.started))
+
+		// Hashing happens on the verifiers so this worker can go straight back to requesting
+		select {
+		case sw.results <- &pieceResult{state.work.index, state.buffer, state.work}:
+		case <-sw.ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitTorrent/message"
+	"bitTorrent/peer"
+)
+
+func TestDownloadSinglePieceSmallerThanPieceLength(t *testing.T) {
+	for _, blockSize := range []int{0, MinBlockSize} {
+		data := testData(1024)
+		tor := newTestTorrent(data, 16384)
+		tor.Config.BlockSize = blockSize
+		if len(tor.PieceHashes) != 1 {
+			t.Fatalf("got %d pieces, want 1", len(tor.PieceHashes))
+		}
+		seeder := newFakeSeeder(t, tor, data)
+		tor.Peers = []peer.Peer{seeder.peer()}
+
+		buf := downloadWithin(t, tor, 10*time.Second)
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("block size %d: downloaded data differs", blockSize)
+		}
+		requests := seeder.received()
+		if len(requests) != 1 || requests[0] != (blockRequest{0, 0, 1024}) {
+			t.Errorf("block size %d: got requests %v, want a single 1024 byte block", blockSize, requests)
+		}
+	}
+}
+
+func TestWaitForWorkStaysInterestedAtMaxActivePieces(t *testing.T) {
+	picker := newPiecePicker(testWork(4), 4, Sequential{}, 1)
+	if pw, _ := picker.tryNext(fullBitfield(4)); pw == nil {
+		t.Fatal("could not take the only slot")
+	}
+	s, remote := newTestSession(t, picker, 4)
+	copy(s.client.Bitfield, fullBitfield(4))
+
+	got := make(chan *pieceWork, 1)
+	go func() {
+		pw, _ := s.waitForWork()
+		got <- pw
+	}()
+	// Nothing at all should be sent while we wait for a slot, least of all NotInterested
+	remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if msg, err := message.ReadMessage(remote); err == nil {
+		t.Fatalf("sent message %d while waiting for a free slot", msg.ID)
+	}
+
+	picker.release()
+	// A keep alive makes the session look at the picker again without waiting for its poll
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Write((*message.Message)(nil).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pw := <-got:
+		if pw == nil || pw.index != 1 {
+			t.Errorf("got %v, want piece 1", pw)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForWork did not pick up the freed slot")
+	}
+}
+
+// Every block of every piece requested exactly once, none empty and none above blockSize
+func checkRequests(t *testing.T, tor *Torrent, requests []blockRequest, blockSize int) {
+	t.Helper()
+	covered := map[int]int{}
+	for _, r := range requests {
+		if r.length <= 0 || r.length > blockSize {
+			t.Errorf("request for piece %d at %d has length %d", r.index, r.begin, r.length)
+		}
+		if r.begin%blockSize != 0 {
+			t.Errorf("request for piece %d starts at %d, not on a block boundary", r.index, r.begin)
+		}
+		covered[r.index] += r.length
+	}
+	for index := range tor.PieceHashes {
+		if want := tor.CalculateLengthForPiece(index); covered[index] != want {
+			t.Errorf("requests for piece %d cover %d bytes, want %d", index, covered[index], want)
+		}
+	}
+}
+
+func TestBlockLength(t *testing.T) {
+	state := newPieceProgress(&pieceWork{length: 20000}, BLOCKSIZE)
+	for _, tt := range []struct{ begin, want int }{
+		{0, BLOCKSIZE},
+		{BLOCKSIZE, 20000 - BLOCKSIZE},
+		{20000, 0},
+		{20000 + BLOCKSIZE, 0},
+	} {
+		if got := state.blockLength(tt.begin); got != tt.want {
+			t.Errorf("blockLength(%d) = %d, want %d", tt.begin, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadShortFinalPiece(t *testing.T) {
+	// Three pieces, the last one 1808 bytes and so a single short block
+	data := testData(10000)
+	tor := newTestTorrent(data, 4096)
+	seeder := newFakeSeeder(t, tor, data)
+	tor.Peers = []peer.Peer{seeder.peer()}
+
+	buf := downloadWithin(t, tor, 10*time.Second)
+	if !bytes.Equal(buf, data) {
+		t.Fatal("downloaded data differs")
+	}
+	requests := seeder.received()
+	if len(requests) != 3 {
+		t.Errorf("got %d requests, want 3: %v", len(requests), requests)
+	}
+	checkRequests(t, tor, requests, BLOCKSIZE)
+}
+
+func TestDownloadOddBlockSizeRemainder(t *testing.T) {
+	// 1 KiB blocks over 5000 byte pieces end each piece on a short block: 4*1024+904,
+	// and the 4000 byte final piece on 3*1024+928
+	data := testData(9000)
+	tor := newTestTorrent(data, 5000)
+	tor.Config.BlockSize = 1024
+	seeder := newFakeSeeder(t, tor, data)
+	tor.Peers = []peer.Peer{seeder.peer()}
+
+	buf := downloadWithin(t, tor, 10*time.Second)
+	if !bytes.Equal(buf, data) {
+		t.Fatal("downloaded data differs")
+	}
+	requests := seeder.received()
+	checkRequests(t, tor, requests, 1024)
+	short := map[blockRequest]bool{}
+	for _, r := range requests {
+		if r.length != 1024 {
+			short[r] = true
+		}
+	}
+	want := map[blockRequest]bool{{0, 4096, 904}: true, {1, 3072, 928}: true}
+	if !maps.Equal(short, want) {
+		t.Errorf("short blocks requested: %v, want %v", short, want)
+	}
+}
+
+func TestStrayBlocksAreIgnored(t *testing.T) {
+	data := testData(8192)
+	tor := newTestTorrent(data, 4096)
+	tor.Config.MaxPiecesPerPeer = 1
+	tor.Config.BlockSize = 1024
+	seeder := newFakeSeeder(t, tor, data)
+	var sentStray sync.Once
+	seeder.onRequest = func(c *seederConn, r blockRequest) error {
+		var err error
+		sentStray.Do(func() {
+			// A block of a piece nobody asked for, one with garbage at an offset we never
+			// requested and one beyond the end of the piece, before the real answer
+			other := 1 - r.index
+			if err = c.sendPiece(other, 0, make([]byte, 1024)); err != nil {
+				return
+			}
+			if err = c.sendPiece(r.index, 512, make([]byte, 1024)); err != nil {
+				return
+			}
+			err = c.sendPiece(r.index, 1<<20, make([]byte, 16))
+		})
+		if err != nil {
+			return err
+		}
+		return c.answer(r)
+	}
+	tor.Peers = []peer.Peer{seeder.peer()}
+
+	buf := downloadWithin(t, tor, 10*time.Second)
+	if !bytes.Equal(buf, data) {
+		t.Fatal("downloaded data differs, a stray block was written")
+	}
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if len(seeder.conns) != 1 {
+		t.Errorf("peer was dialed %d times, the stray blocks dropped the connection", len(seeder.conns))
+	}
+}
+
+func TestChokeRequeuesOutstandingRequests(t *testing.T) {
+	data := testData(16384)
+	tor := newTestTorrent(data, 4096)
+	tor.Config.BlockSize = 1024
+	seeder := newFakeSeeder(t, tor, data)
+	var requests int
+	var unchoked atomic.Bool
+	seeder.onRequest = func(c *seederConn, r blockRequest) error {
+		requests++
+		if requests == 3 {
+			// A choke drops every request so far (BEP3), the unchoke follows a little later
+			if err := c.send(&message.Message{ID: message.MsgChoke}); err != nil {
+				return err
+			}
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				if c.send(&message.Message{ID: message.MsgUnchoke}) == nil {
+					unchoked.Store(true)
+				}
+			}()
+		}
+		if !unchoked.Load() {
+			return nil
+		}
+		return c.answer(r)
+	}
+	tor.Peers = []peer.Peer{seeder.peer()}
+
+	buf := downloadWithin(t, tor, 10*time.Second)
+	if !bytes.Equal(buf, data) {
+		t.Fatal("downloaded data differs")
+	}
+	received := seeder.received()
+	asked := map[blockRequest]int{}
+	for _, r := range received {
+		asked[r]++
+	}
+	for _, r := range received[:3] {
+		if asked[r] < 2 {
+			t.Errorf("block %d of piece %d was dropped by the choke and never asked for again", r.begin, r.index)
+		}
+	}
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if len(seeder.conns) != 1 {
+		t.Errorf("peer was dialed %d times, the download should carry on over one connection", len(seeder.conns))
+	}
+}
+
+func TestResetRequestsOnChoke(t *testing.T) {
+	picker := newPiecePicker(nil, 1, RarestFirst{}, 0)
+	s, _ := newTestSession(t, picker, 1)
+	state := newPieceProgress(&pieceWork{length: 4096}, 1024)
+	s.active = []*pieceProgress{state}
+	// Blocks 0 and 2 are asked for, block 1 already arrived
+	state.received[1] = true
+	state.pending = map[int]int{0: 1024, 2048: 1024}
+	state.requested = 3072
+	s.backlog = 2
+
+	s.resetRequests()
+	if s.backlog != 0 || len(state.pending) != 0 {
+		t.Errorf("backlog %d and %d pending after a choke, want none", s.backlog, len(state.pending))
+	}
+	if state.requested != 0 {
+		t.Errorf("request cursor at %d, want 0 so block 0 is asked for again", state.requested)
+	}
+}
+
+// AsPiece and the pending length are all that keep a block inside the piece buffer
+func TestCheckStatePieceBounds(t *testing.T) {
+	picker := newPiecePicker(nil, 2, RarestFirst{}, 0)
+	s, remote := newTestSession(t, picker, 2)
+	state := newPieceProgress(&pieceWork{index: 1, length: 2500}, 1024)
+	state.pending = map[int]int{0: 1024, 2048: 452}
+	s.active = []*pieceProgress{state}
+	s.backlog = 2
+
+	block := func(begin, length int) *message.Message {
+		payload := make([]byte, 8+length)
+		payload[3] = 1
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		return &message.Message{ID: message.MsgPiece, Payload: payload}
+	}
+	steps := []struct {
+		name    string
+		msg     *message.Message
+		wantErr bool
+	}{
+		{"too short for index and begin", &message.Message{ID: message.MsgPiece, Payload: make([]byte, 7)}, true},
+		{"block one byte short", block(0, 1023), true},
+		{"block one byte long", block(0, 1025), true},
+		{"last block running past the piece", block(2048, 453), true},
+		{"begin past the piece", block(4096, 0), false},
+		{"empty block at the end", block(2500, 0), false},
+		{"whole block", block(0, 1024), false},
+		{"same block again", block(0, 1024), false},
+	}
+	go func() {
+		for _, step := range steps {
+			remote.Write(step.msg.Serialize())
+		}
+	}()
+	for _, step := range steps {
+		_, err := s.checkState()
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: got error %v, want one %t", step.name, err, step.wantErr)
+		}
+	}
+	if state.downloaded != 1024 || s.backlog != 1 || len(state.pending) != 1 || !state.received[0] {
+		t.Errorf("downloaded %d with backlog %d and pending %v, want only the first block taken",
+			state.downloaded, s.backlog, state.pending)
+	}
+}
@@ -0,0 +1,77 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrStalled = errors.New("download stalled")
+
+// Logs why nothing is finishing: who we are connected to, whether they choke us and what is left
+func (t *Torrent) logStall(picker *piecePicker, idle time.Duration) {
+	var remaining []string
+	for _, index := range t.MissingPieces() {
+		remaining = append(remaining, fmt.Sprint(index))
+	}
+	left := len(remaining)
+	if len(remaining) > 20 {
+		remaining = append(remaining[:20], "...")
+	}
+
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	log.Printf("No Piece Completed In %s: %d Peers Connected, %d Pieces Left, %d Not Held By Any Peer",
+		idle.Round(time.Second), len(t.connected), left, picker.unavailable())
+	log.Printf("Pieces Left: %s", strings.Join(remaining, " "))
+
+	addrs := make([]string, 0, len(t.connected))
+	for addr := range t.connected {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		cp := t.connected[addr]
+		connected := time.Since(cp.since)
+		rate := float64(cp.downloaded.Load()) / connected.Seconds()
+		log.Printf("  %s choked %t, %.0f B/s over %s", addr, cp.choked.Load(), rate, connected.Round(time.Second))
+	}
+}
+
+// Fires once no piece has completed for timeout. Only a completed piece restarts it,
+// other wakeups of DownloadTo must not hide a stall
+type stallTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newStallTimer(timeout time.Duration) *stallTimer {
+	st := &stallTimer{timeout: timeout}
+	if timeout > 0 {
+		st.timer = time.NewTimer(timeout)
+	}
+	return st
+}
+
+// Nil when stall detection is off, a nil channel never fires in a select
+func (st *stallTimer) C() <-chan time.Time {
+	if st.timer == nil {
+		return nil
+	}
+	return st.timer.C
+}
+
+func (st *stallTimer) reset() {
+	if st.timer != nil {
+		st.timer.Reset(st.timeout)
+	}
+}
+
+func (st *stallTimer) stop() {
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+}
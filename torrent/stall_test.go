@@ -0,0 +1,50 @@
+package torrent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"bitTorrent/peer"
+)
+
+func TestAbortOnStallWithPeersThatNeverServe(t *testing.T) {
+	data := testData(4096)
+	tor := newTestTorrent(data, 1024)
+	tor.Config.StallTimeout = 500 * time.Millisecond
+	tor.Config.AbortOnStall = true
+	seeder := newFakeSeeder(t, tor, data)
+	// Unchokes us and takes every request, but never sends a block
+	seeder.onRequest = func(c *seederConn, r blockRequest) error { return nil }
+	tor.Peers = []peer.Peer{seeder.peer()}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tor.Download()
+		done <- err
+	}()
+	// Wakes DownloadTo more often than StallTimeout, only a completed piece may restart the clock
+	wake := time.NewTicker(100 * time.Millisecond)
+	defer wake.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrStalled) {
+				t.Fatalf("got %v, want ErrStalled", err)
+			}
+			return
+		case <-wake.C:
+			tor.swarmMu.Lock()
+			if tor.swarm != nil {
+				select {
+				case tor.swarm.idle <- struct{}{}:
+				default:
+				}
+			}
+			tor.swarmMu.Unlock()
+		case <-timeout:
+			t.Fatal("Download did not report the stall")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package torrent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+type Stats struct {
+	Name            string
+	Length          int
+	PiecesTotal     int
+	PiecesCompleted int
+	BytesCompleted  int
+	Elapsed         time.Duration
+	// Average wire bytes per second received since the download started
+	DownloadRate float64
+	Metrics      Metrics
+	// SHA-256 of each written file by path, only in OnComplete with Config.HashFiles or FileManifest
+	FileHashes map[string]string
+}
+
+func (t *Torrent) stats(completed int, started time.Time) Stats {
+	s := Stats{
+		Name:            t.Name,
+		Length:          t.Length,
+		PiecesTotal:     len(t.PieceHashes),
+		PiecesCompleted: completed,
+		BytesCompleted:  t.bytesCompleted(completed),
+		Metrics:         t.Metrics(),
+	}
+	if !started.IsZero() {
+		s.Elapsed = time.Since(started)
+		s.DownloadRate = float64(s.Metrics.BytesDownloaded) / s.Elapsed.Seconds()
+	}
+	return s
+}
+
+// Snapshot of the running (or last) download, safe to call from any goroutine
+func (t *Torrent) Stats() Stats {
+	done, _ := t.Progress()
+	t.completedMu.Lock()
+	started := t.started
+	t.completedMu.Unlock()
+	return t.stats(done, started)
+}
+
+type statsResponse struct {
+	Torrents []Stats
+	Total    Stats // sums over every torrent, Name and Elapsed are left empty
+}
+
+// Serves the Stats of every torrent as JSON for monitoring, along with their totals
+func NewStatsHandler(torrents ...*Torrent) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resp := statsResponse{Torrents: make([]Stats, 0, len(torrents))}
+		for _, t := range torrents {
+			s := t.Stats()
+			resp.Torrents = append(resp.Torrents, s)
+			resp.Total.Length += s.Length
+			resp.Total.PiecesTotal += s.PiecesTotal
+			resp.Total.PiecesCompleted += s.PiecesCompleted
+			resp.Total.BytesCompleted += s.BytesCompleted
+			resp.Total.DownloadRate += s.DownloadRate
+			resp.Total.Metrics.PeersConnected += s.Metrics.PeersConnected
+			resp.Total.Metrics.BytesDownloaded += s.Metrics.BytesDownloaded
+			resp.Total.Metrics.BytesUploaded += s.Metrics.BytesUploaded
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// Runs the Config.StatsAddr server for this torrent, the returned func shuts it down
+func (t *Torrent) serveStats() (func(), error) {
+	if t.Config.StatsAddr == "" {
+		return func() {}, nil
+	}
+	ln, err := net.Listen("tcp", t.Config.StatsAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: NewStatsHandler(t)}
+	go func() {
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Stats Server Stopped:", err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
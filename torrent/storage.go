@@ -0,0 +1,323 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type SyncMode int
+
+const (
+	SyncOnClose SyncMode = iota
+	SyncPerPiece
+	SyncPeriodic
+)
+
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch s {
+	case "close":
+		return SyncOnClose, nil
+	case "piece":
+		return SyncPerPiece, nil
+	case "periodic":
+		return SyncPeriodic, nil
+	}
+	return 0, fmt.Errorf("unknown sync mode %q", s)
+}
+
+type memoryWriter []byte
+
+func (m memoryWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the torrent", len(p), off)
+	}
+	return copy(m[off:], p), nil
+}
+
+func (m memoryWriter) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Suffix of files that are still downloading, Finish renames them once everything is verified
+const PartialSuffix = ".part"
+
+type storageFile struct {
+	file    *os.File
+	offset  int64
+	length  int64
+	path    string // final name
+	partial bool   // file is open under path + PartialSuffix, false for a reused finished file
+}
+
+// Storage maps torrent offsets onto the files on disk. WriteAt is safe to call
+// from several goroutines as long as the written ranges do not overlap.
+type Storage struct {
+	files    []storageFile
+	mode     SyncMode
+	interval time.Duration
+
+	mu       sync.Mutex
+	dirty    bool
+	lastSync time.Time
+	finished bool
+	fresh    bool
+	// Set while files reused under their final name have not been checked by LoadResume or Recheck
+	unverified bool
+}
+
+var ErrPathConflict = errors.New("output path is taken by something else")
+
+func NewStorage(dir string, t *Torrent) (*Storage, error) {
+	s := &Storage{
+		mode:     t.Config.Sync,
+		interval: t.Config.SyncInterval,
+		lastSync: time.Now(),
+		fresh:    true,
+	}
+
+	paths := [][]string{{t.Name}}
+	lengths := []int{t.Length}
+	if len(t.Files) > 0 {
+		paths, lengths = nil, nil
+		for _, f := range t.Files {
+			paths = append(paths, append([]string{t.Name}, f.Path...))
+			lengths = append(lengths, f.Length)
+		}
+	}
+	// Every path is checked before anything is created, so a conflict leaves the directory
+	// as it was and a long download can not fail on the very last rename or write
+	reuse := make([]bool, len(paths))
+	for i, parts := range paths {
+		var err error
+		reuse[i], err = checkStoragePath(dir, parts, int64(lengths[i]), t.Config.ReuseExisting)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	offset := int64(0)
+	for i, parts := range paths {
+		path := filepath.Join(append([]string{dir}, parts...)...)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		// A file under the final name was not necessarily created by us, it is opened as is and never truncated
+		if reuse[i] {
+			file, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s.files = append(s.files, storageFile{file, offset, int64(lengths[i]), path, false})
+			s.fresh, s.unverified = false, true
+			offset += int64(lengths[i])
+			continue
+		}
+		// Everything else is downloaded into a .part file so an interrupted download never looks finished
+		if _, err := os.Stat(path + PartialSuffix); err == nil {
+			s.fresh = false
+		}
+		file, err := os.OpenFile(path+PartialSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, storageFile{file, offset, int64(lengths[i]), path, true})
+		// Truncate bumps the modification time even when the size is right, which would void a resume file
+		info, err := file.Stat()
+		if err == nil && info.Size() != int64(lengths[i]) {
+			err = file.Truncate(int64(lengths[i]))
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		offset += int64(lengths[i])
+	}
+	return s, nil
+}
+
+// Looks at everything NewStorage would touch for one file: the directories leading to it,
+// its final name and its .part file. Reports whether an existing file under the final
+// name is reused, which needs reuseExisting and the exact size the torrent expects.
+func checkStoragePath(dir string, parts []string, length int64, reuseExisting bool) (bool, error) {
+	current := dir
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Stat(current)
+		if err == nil && !info.IsDir() {
+			return false, fmt.Errorf("%w: %s already exists as a file", ErrPathConflict, current)
+		}
+		if err != nil {
+			// Nothing further down can exist either
+			return false, nil
+		}
+	}
+	path := filepath.Join(current, parts[len(parts)-1])
+	if info, err := os.Stat(path + PartialSuffix); err == nil && !info.Mode().IsRegular() {
+		return false, fmt.Errorf("%w: %s already exists and is not a file", ErrPathConflict, path+PartialSuffix)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, nil
+	}
+	switch {
+	case info.IsDir():
+		return false, fmt.Errorf("%w: %s already exists as a directory", ErrPathConflict, path)
+	case !reuseExisting:
+		return false, fmt.Errorf("%w: %s already exists", ErrPathConflict, path)
+	case !info.Mode().IsRegular() || info.Size() != length:
+		return false, fmt.Errorf("%w: %s already exists and is not the %d byte file of this torrent", ErrPathConflict, path, length)
+	}
+	return true, nil
+}
+
+var errUnverifiedFiles = errors.New("files reused under their final name have to be checked with LoadResume or Recheck before writing")
+
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	if s.needsCheck() {
+		return 0, errUnverifiedFiles
+	}
+	written := 0
+	for _, f := range s.files {
+		if off+int64(len(p)) <= f.offset || off >= f.offset+f.length {
+			continue
+		}
+		start := max(off, f.offset)
+		end := min(off+int64(len(p)), f.offset+f.length)
+		n, err := f.file.WriteAt(p[start-off:end-off], start-f.offset)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	if written != len(p) {
+		return written, fmt.Errorf("write of %d bytes at %d is outside the torrent", len(p), off)
+	}
+	return written, s.afterWrite()
+}
+
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for _, f := range s.files {
+		if off+int64(len(p)) <= f.offset || off >= f.offset+f.length {
+			continue
+		}
+		start := max(off, f.offset)
+		end := min(off+int64(len(p)), f.offset+f.length)
+		n, err := f.file.ReadAt(p[start-off:end-off], start-f.offset)
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	if read != len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (s *Storage) afterWrite() error {
+	s.mu.Lock()
+	s.dirty = true
+	due := s.mode == SyncPerPiece || (s.mode == SyncPeriodic && time.Since(s.lastSync) >= s.interval)
+	s.mu.Unlock()
+	if due {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *Storage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	for _, f := range s.files {
+		err := f.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	s.dirty = false
+	s.lastSync = time.Now()
+	return nil
+}
+
+func (s *Storage) Close() error {
+	err := s.Flush()
+	for _, f := range s.files {
+		err = errors.Join(err, f.file.Close())
+	}
+	return err
+}
+
+func (s *Storage) needsCheck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unverified
+}
+
+// Called once LoadResume or Recheck has looked at the reused files, from then on they may be written
+func (s *Storage) markVerified() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unverified = false
+}
+
+// Reports whether NewStorage created every file, so there is nothing on disk worth rechecking
+func (s *Storage) Fresh() bool {
+	return s.fresh
+}
+
+// Sizes and modification times of the files as they are on disk right now
+func (s *Storage) stamps() ([]resumeStamp, error) {
+	stamps := make([]resumeStamp, len(s.files))
+	for i, f := range s.files {
+		path := f.path
+		if f.partial && !s.finished {
+			path += PartialSuffix
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = resumeStamp{info.Size(), info.ModTime().UnixNano()}
+	}
+	return stamps, nil
+}
+
+// Closes the files and moves every .part file to its final name. Only call this
+// once the whole torrent is verified, the Storage can not be used afterwards.
+func (s *Storage) Finish() error {
+	err := s.Close()
+	if err != nil {
+		return err
+	}
+	for _, f := range s.files {
+		if !f.partial {
+			continue
+		}
+		err = os.Rename(f.path+PartialSuffix, f.path)
+		if err != nil {
+			return err
+		}
+	}
+	s.finished = true
+	return nil
+}
@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bitTorrent/peer"
+)
+
+func TestStorageDownloadsIntoPartFiles(t *testing.T) {
+	dir := t.TempDir()
+	data := testData(3000)
+	tor := newTestTorrent(data, 1024)
+	s, err := NewStorage(dir, tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Fresh() {
+		t.Error("storage in an empty directory is not fresh")
+	}
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, tor.Name)
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("final name exists before Finish: %v", err)
+	}
+	if err := s.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("finished file differs: %v", err)
+	}
+	if _, err := os.Stat(path + PartialSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf(".part file left behind: %v", err)
+	}
+}
+
+func TestStorageLeavesExistingFilesAlone(t *testing.T) {
+	data := testData(3000)
+	unrelated := []byte("someone else's file")
+
+	tests := []struct {
+		name     string
+		contents []byte
+		reuse    bool
+	}{
+		{"existing file", unrelated, false},
+		{"existing file of the wrong size with reuse", unrelated, true},
+		{"finished download without reuse", data, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tor := newTestTorrent(data, 1024)
+			tor.Config.ReuseExisting = tt.reuse
+			path := filepath.Join(dir, tor.Name)
+			if err := os.WriteFile(path, tt.contents, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := NewStorage(dir, tor)
+			if !errors.Is(err, ErrPathConflict) {
+				t.Fatalf("got %v, want ErrPathConflict", err)
+			}
+			got, _ := os.ReadFile(path)
+			if !bytes.Equal(got, tt.contents) {
+				t.Error("existing file was modified")
+			}
+		})
+	}
+}
+
+func TestStorageReusesFinishedFileAfterRecheck(t *testing.T) {
+	dir := t.TempDir()
+	data := testData(3000)
+	tor := newTestTorrent(data, 1024)
+	tor.Config.ReuseExisting = true
+	path := filepath.Join(dir, tor.Name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStorage(dir, tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Fresh() {
+		t.Error("storage reusing a file is fresh")
+	}
+	if _, err := s.WriteAt(data[:10], 0); !errors.Is(err, errUnverifiedFiles) {
+		t.Fatalf("write before Recheck: got %v, want errUnverifiedFiles", err)
+	}
+	tor.Peers = []peer.Peer{peer.NewPeer(net.IP{127, 0, 0, 1}, 1)}
+	if err := tor.DownloadTo(s); !errors.Is(err, errUnverifiedFiles) {
+		t.Fatalf("DownloadTo before Recheck: got %v, want errUnverifiedFiles", err)
+	}
+
+	passed, failed, err := tor.Recheck(s)
+	if err != nil || passed != len(tor.PieceHashes) || failed != 0 {
+		t.Fatalf("Recheck: %d passed, %d failed, %v", passed, failed, err)
+	}
+	if _, err := s.WriteAt(data[:10], 0); err != nil {
+		t.Errorf("write after Recheck: %v", err)
+	}
+}
+
+func TestStorageConflictsCreateNothing(t *testing.T) {
+	data := testData(3000)
+	multi := func() *Torrent {
+		tor := newTestTorrent(data, 1024)
+		tor.Files = []File{
+			{Path: []string{"a"}, Length: 1000},
+			{Path: []string{"sub", "b"}, Length: 2000},
+		}
+		return tor
+	}
+	tests := []struct {
+		name    string
+		tor     *Torrent
+		prepare func(dir string) error
+	}{
+		{"regular file where the last file goes", multi(), func(dir string) error {
+			if err := os.MkdirAll(filepath.Join(dir, "test", "sub"), 0o755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, "test", "sub", "b"), []byte("mine"), 0o644)
+		}},
+		{"file where a directory goes", multi(), func(dir string) error {
+			if err := os.MkdirAll(filepath.Join(dir, "test"), 0o755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, "test", "sub"), []byte("mine"), 0o644)
+		}},
+		{"file where the torrent directory goes", multi(), func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, "test"), []byte("mine"), 0o644)
+		}},
+		{"directory where the file goes", newTestTorrent(data, 1024), func(dir string) error {
+			return os.Mkdir(filepath.Join(dir, "test"), 0o755)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := tt.prepare(dir); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewStorage(dir, tt.tor); !errors.Is(err, ErrPathConflict) {
+				t.Fatalf("got %v, want ErrPathConflict", err)
+			}
+			for _, name := range []string{"test.part", "test/a.part", "test/sub/b.part"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+					t.Errorf("%s was created despite the conflict", name)
+				}
+			}
+		})
+	}
+}
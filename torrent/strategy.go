@@ -0,0 +1,39 @@
+package torrent
+
+import "bitTorrent/helpers/bitfield"
+
+// Chooses the next piece to download from a peer. wanted holds the pieces nobody
+// is downloading yet, availability counts how many connected peers have each
+// piece and have is the peer's own bitfield. Next is called with the picker
+// locked so it must not block.
+type PieceStrategy interface {
+	Next(availability []int, wanted bitfield.Bitfield, have bitfield.Bitfield) (index int, ok bool)
+}
+
+// Lowest index first, so a prefix of the torrent becomes usable early
+type Sequential struct{}
+
+func (Sequential) Next(availability []int, wanted bitfield.Bitfield, have bitfield.Bitfield) (int, bool) {
+	for index := range availability {
+		if wanted.CheckPiece(index) && have.CheckPiece(index) {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// The piece the fewest connected peers have goes first, ties go to the lowest index
+type RarestFirst struct{}
+
+func (RarestFirst) Next(availability []int, wanted bitfield.Bitfield, have bitfield.Bitfield) (int, bool) {
+	best := -1
+	for index, count := range availability {
+		if !wanted.CheckPiece(index) || !have.CheckPiece(index) {
+			continue
+		}
+		if best == -1 || count < availability[best] {
+			best = index
+		}
+	}
+	return best, best != -1
+}
@@ -0,0 +1,52 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// StreamHandler serves the torrent over HTTP while it downloads. Range requests
+// past the verified prefix block until the pieces arrive, so it pairs with
+// SequentialDownload.
+type StreamHandler struct {
+	t *Torrent
+	r io.ReaderAt
+}
+
+func NewStreamHandler(t *Torrent, r io.ReaderAt) *StreamHandler {
+	return &StreamHandler{t: t, r: r}
+}
+
+func (h *StreamHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Setting the type up front stops ServeContent from sniffing, which would block on the first piece
+	contentType := mime.TypeByExtension(filepath.Ext(h.t.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	reader := &prefixReader{ctx: req.Context(), t: h.t, r: h.r}
+	http.ServeContent(w, req, h.t.Name, time.Time{}, io.NewSectionReader(reader, 0, int64(h.t.Length)))
+}
+
+type prefixReader struct {
+	ctx context.Context
+	t   *Torrent
+	r   io.ReaderAt
+}
+
+func (p *prefixReader) ReadAt(b []byte, off int64) (int, error) {
+	end := min(off+int64(len(b)), int64(p.t.Length))
+	for int64(p.t.ContiguousLength()) < end {
+		select {
+		case <-p.ctx.Done():
+			return 0, p.ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	return p.r.ReadAt(b, off)
+}
@@ -0,0 +1,216 @@
+package torrent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bitTorrent/peer"
+)
+
+// Workers of the download that is currently running, AddPeers feeds into this
+type swarm struct {
+	opts    peer.Options
+	picker  *piecePicker
+	results chan *pieceResult
+	active  int
+	spare   []peer.Peer // known peers waiting for a free slot under MaxPeers
+	seeds   int         // running web seed workers
+	// Signalled whenever the last worker exits, DownloadTo then checks whether anything is left
+	idle chan struct{}
+
+	// Cancelled by stopSwarm, every worker watches it wherever it could block
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Remembers every peer in t.Peers and starts a worker for as many as MaxPeers allows
+func (t *Torrent) startSwarm(opts peer.Options, picker *piecePicker, results chan *pieceResult) *swarm {
+	t.swarmMu.Lock()
+	defer t.swarmMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	opts.Context = ctx
+	t.swarm = &swarm{opts: opts, picker: picker, results: results, ctx: ctx, cancel: cancel, idle: make(chan struct{}, 1)}
+	spawned := map[string]bool{}
+	for _, p := range t.Peers {
+		if spawned[p.String()] {
+			continue
+		}
+		spawned[p.String()] = true
+		t.discoverLocked(p)
+		t.spawnLocked(p)
+	}
+	s := t.swarm
+	for _, seed := range t.HTTPSeeds {
+		s.seeds++
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			t.httpSeedWorker(seed, s)
+			t.swarmMu.Lock()
+			s.seeds--
+			s.signalIfIdle()
+			t.swarmMu.Unlock()
+		}()
+	}
+	// Every peer may have been blocked or a duplicate, DownloadTo has to hear about it too
+	s.signalIfIdle()
+	return s
+}
+
+// Stops every worker and only returns once they have all exited and closed their connections
+func (t *Torrent) stopSwarm() {
+	t.swarmMu.Lock()
+	s := t.swarm
+	t.swarm = nil
+	t.swarmMu.Unlock()
+	if s == nil {
+		return
+	}
+	s.cancel()
+	// Unblocks workers sitting in a read, they clean up through disconnect as usual
+	t.peersMu.Lock()
+	for _, cp := range t.connected {
+		cp.client.Conn.Close()
+	}
+	t.peersMu.Unlock()
+	s.wg.Wait()
+}
+
+// Adds peers found after the tracker announce (manual, another tracker, DHT...).
+// Peers we already know are skipped, new ones get a worker straight away if a
+// download is running. Returns how many peers were new.
+func (t *Torrent) AddPeers(peers []peer.Peer) int {
+	t.swarmMu.Lock()
+	defer t.swarmMu.Unlock()
+	for _, p := range t.Peers {
+		t.discoverLocked(p)
+	}
+	added := 0
+	for _, p := range peers {
+		if !t.discoverLocked(p) {
+			continue
+		}
+		t.Peers = append(t.Peers, p)
+		added++
+		if t.swarm != nil {
+			t.spawnLocked(p)
+		}
+	}
+	return added
+}
+
+// Reports p to OnPeerDiscovered the first time it is seen, whether it came in t.Peers
+// or through AddPeers. False for a peer seen before. Call with swarmMu held
+func (t *Torrent) discoverLocked(p peer.Peer) bool {
+	if t.known[p.String()] {
+		return false
+	}
+	if t.known == nil {
+		t.known = map[string]bool{}
+	}
+	t.known[p.String()] = true
+	if t.Config.OnPeerDiscovered != nil {
+		t.Config.OnPeerDiscovered(p)
+	}
+	return true
+}
+
+func (t *Torrent) spawnLocked(p peer.Peer) {
+	s := t.swarm
+	if t.Config.MaxPeers > 0 && s.active >= t.Config.MaxPeers {
+		s.spare = append(s.spare, p)
+		return
+	}
+	s.active++
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t.startDownloadWorker(p, s)
+		t.workerDone(s)
+	}()
+}
+
+// Frees the worker's slot and hands it to the next spare peer
+func (t *Torrent) workerDone(s *swarm) {
+	t.swarmMu.Lock()
+	defer t.swarmMu.Unlock()
+	s.active--
+	if t.swarm == s && !s.picker.isClosed() && len(s.spare) > 0 {
+		p := s.spare[0]
+		s.spare = s.spare[1:]
+		t.spawnLocked(p)
+	}
+	s.signalIfIdle()
+}
+
+// Call with swarmMu held
+func (s *swarm) signalIfIdle() {
+	if s.active > 0 || s.seeds > 0 {
+		return
+	}
+	select {
+	case s.idle <- struct{}{}:
+	default:
+	}
+}
+
+// Wakes DownloadTo after a piece went back to the picker, with no workers left nobody will fetch it
+func (t *Torrent) wakeIfIdle() {
+	t.swarmMu.Lock()
+	defer t.swarmMu.Unlock()
+	if t.swarm != nil {
+		t.swarm.signalIfIdle()
+	}
+}
+
+// True once no worker is left and no piece is on its way to DownloadTo, the download can not finish
+func (t *Torrent) exhausted(s *swarm) bool {
+	t.swarmMu.Lock()
+	workers := s.active + s.seeds
+	t.swarmMu.Unlock()
+	return workers == 0 && s.picker.inFlight() == 0
+}
+
+// Spaces out new connections so starting a download does not fire every SYN at once
+type dialPacer struct {
+	mu       sync.Mutex
+	next     time.Time
+	interval time.Duration
+}
+
+func newDialPacer(perSecond int) *dialPacer {
+	if perSecond <= 0 {
+		return &dialPacer{}
+	}
+	return &dialPacer{interval: time.Second / time.Duration(perSecond)}
+}
+
+// Blocks until this caller's turn to dial, false if ctx ended first
+func (d *dialPacer) wait(ctx context.Context) bool {
+	if d == nil || d.interval == 0 {
+		return ctx.Err() == nil
+	}
+	d.mu.Lock()
+	now := time.Now()
+	if d.next.Before(now) {
+		d.next = now
+	}
+	delay := d.next.Sub(now)
+	d.next = d.next.Add(d.interval)
+	d.mu.Unlock()
+	return sleepCtx(ctx, delay)
+}
+
+// Like time.Sleep but gives up with false when ctx is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"maps"
+	"net"
+	"testing"
+
+	"bitTorrent/peer"
+)
+
+func TestAddPeersReportsEachPeerOnce(t *testing.T) {
+	discovered := map[string]int{}
+	tor := &Torrent{Config: DefaultConfig()}
+	tor.Config.OnPeerDiscovered = func(p peer.Peer) { discovered[p.String()]++ }
+
+	a := peer.NewPeer(net.IP{10, 0, 0, 1}, 6881)
+	b := peer.NewPeer(net.IP{10, 0, 0, 2}, 6881)
+	if added := tor.AddPeers([]peer.Peer{a, b, a}); added != 2 {
+		t.Errorf("first AddPeers added %d, want 2", added)
+	}
+	// The same peers coming back from another tracker or a re-announce
+	if added := tor.AddPeers([]peer.Peer{b, peer.NewPeer(net.ParseIP("::ffff:10.0.0.1"), 6881)}); added != 0 {
+		t.Errorf("second AddPeers added %d, want 0", added)
+	}
+	if len(discovered) != 2 || discovered[a.String()] != 1 || discovered[b.String()] != 1 {
+		t.Errorf("OnPeerDiscovered calls: %v", discovered)
+	}
+}
+
+func TestInitialPeersAreReportedOnce(t *testing.T) {
+	discovered := map[string]int{}
+	tor := newTestTorrent(testData(1024), 1024)
+	tor.Config.OnPeerDiscovered = func(p peer.Peer) { discovered[p.String()]++ }
+	a := peer.NewPeer(net.IP{10, 0, 0, 1}, 6881)
+	b := peer.NewPeer(net.IP{10, 0, 0, 2}, 6881)
+	c := peer.NewPeer(net.IP{10, 0, 0, 3}, 6881)
+	d := peer.NewPeer(net.IP{10, 0, 0, 4}, 6881)
+	tor.Peers = []peer.Peer{a, b, a}
+
+	// A closed picker sends every worker straight home, nothing is dialed
+	run := func() {
+		picker := newPiecePicker(nil, 1, RarestFirst{}, 0)
+		picker.close()
+		tor.startSwarm(peer.Options{}, picker, make(chan *pieceResult))
+		tor.stopSwarm()
+	}
+	run()
+	if len(discovered) != 2 || discovered[a.String()] != 1 || discovered[b.String()] != 1 {
+		t.Errorf("tracker peers were reported as %v", discovered)
+	}
+	tor.AddPeers([]peer.Peer{b, c})
+	tor.Peers = append(tor.Peers, d)
+	run()
+	want := map[string]int{a.String(): 1, b.String(): 1, c.String(): 1, d.String(): 1}
+	if !maps.Equal(discovered, want) {
+		t.Errorf("OnPeerDiscovered calls: %v, want %v", discovered, want)
+	}
+}
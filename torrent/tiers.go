@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"bitTorrent/peer"
+)
+
+// Tracker tiers to announce to, announce-list when the torrent has one (BEP12) and
+// the plain announce URL otherwise
+func (t *TorrentFile) tiers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
+	}
+	if t.Announce == "" {
+		return nil
+	}
+	return [][]string{{t.Announce}}
+}
+
+// False for trackerless torrents, which only have DHT Nodes or web seeds to go on
+func (t *TorrentFile) HasTrackers() bool {
+	return len(t.tiers()) > 0
+}
+
+// Same as TorrentFile.HasTrackers, an announce-list without an announce URL counts too
+func (t *Torrent) HasTrackers() bool {
+	return t.Announce != "" || len(t.AnnounceList) > 0
+}
+
+// Announces tier by tier and stops at the first tier that gives us any peers.
+// Within a tier trackers are asked in order until one answers, or all at once
+// with Config.ParallelAnnounce, in which case the answers are merged without duplicates.
+func RequestPeersAll(t *TorrentFile, peerID [20]byte, cfg Config) ([]peer.Peer, error) {
+	// Before the copies below are made so tracker ids end up on t
+	if t.trackerIDs == nil {
+		t.trackerIDs = &trackerIDs{ids: map[string]string{}}
+	}
+	var errs []error
+	for _, tier := range t.tiers() {
+		var peers []peer.Peer
+		var err error
+		if cfg.ParallelAnnounce {
+			peers, err = announceTierParallel(t, tier, peerID, cfg)
+		} else {
+			peers, err = announceTier(t, tier, peerID, cfg)
+		}
+		if len(peers) > 0 {
+			return peers, nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no tracker returned any peers")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func announceTier(t *TorrentFile, tier []string, peerID [20]byte, cfg Config) ([]peer.Peer, error) {
+	var errs []error
+	for _, announce := range tier {
+		tf := *t
+		tf.Announce = announce
+		peers, err := RequestPeers(&tf, peerID, cfg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(peers) > 0 {
+			return peers, nil
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// A slow tracker only holds the tier up until AnnounceTimeout
+func announceTierParallel(t *TorrentFile, tier []string, peerID [20]byte, cfg Config) ([]peer.Peer, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	seen := map[string]bool{}
+	var peers []peer.Peer
+	for _, announce := range tier {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tf := *t
+			tf.Announce = announce
+			found, err := RequestPeers(&tf, peerID, cfg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			for _, p := range found {
+				if !seen[p.String()] {
+					seen[p.String()] = true
+					peers = append(peers, p)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return peers, errors.Join(errs...)
+}
@@ -1,21 +1,28 @@
 package torrent
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackpal/bencode-go"
 
+	"bitTorrent/helpers/bitfield"
 	"bitTorrent/message"
 	"bitTorrent/peer"
 )
@@ -35,12 +42,30 @@ func SetVerbose(v bool) {
 }
 
 type trackerRespone struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	Interval   int    `bencode:"interval"`
+	Peers      string `bencode:"peers"`
+	Peers6     string `bencode:"peers6"`
+	Complete   int    `bencode:"complete"`
+	Incomplete int    `bencode:"incomplete"`
+	TrackerID  string `bencode:"tracker id"`
+	// Set instead of everything else when the tracker refused the announce
+	FailureReason string `bencode:"failure reason"`
 }
 
-func RequestPeers(t *TorrentFile, peerID [20]byte, port uint16) ([]peer.Peer, error) {
-	urle, err := t.buildTrackerURL(peerID, port)
+// Swarm health from an announce, Seeders and Leechers are 0 when the tracker leaves them out
+type TrackerInfo struct {
+	Announce string
+	Interval time.Duration
+	Seeders  int
+	Leechers int
+	Peers    int
+}
+
+func RequestPeers(t *TorrentFile, peerID [20]byte, cfg Config) ([]peer.Peer, error) {
+	if t.trackerIDs == nil {
+		t.trackerIDs = &trackerIDs{ids: map[string]string{}}
+	}
+	urle, err := t.buildTrackerURL(peerID, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -54,79 +79,149 @@ func RequestPeers(t *TorrentFile, peerID [20]byte, port uint16) ([]peer.Peer, er
 		return nil, fmt.Errorf("The URL contains the UDP protocol which is not yet supported! The Protocol is %s", annonounceURL.Scheme)
 	}
 
-	resp, err := http.Get(urle)
+	client, err := cfg.httpClient()
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	trackerResp := trackerRespone{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	ctx := context.Background()
+	if cfg.AnnounceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.AnnounceTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urle, nil)
 	if err != nil {
 		return nil, err
 	}
+	// Asking ourselves turns off the transport's own gzip handling, decodeTrackerBody covers both cases
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	return peer.Unmarshal([]byte(trackerResp.Peers))
-}
-
-func GeneratePeerID() [20]byte {
-	var id [20]byte
-	copy(id[:], "-GO0001-123456789012")
-	return id
-}
+	body, err := decodeTrackerBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("tracker %s: %w", t.Announce, err)
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("tracker %s: %w", t.Announce, err)
+	}
+	// A dictionary peer list is silently left out here, dictionaryPeers picks it up below
+	trackerResp := trackerRespone{}
+	err = bencode.Unmarshal(bytes.NewReader(raw), &trackerResp)
+	if err != nil {
+		return nil, fmt.Errorf("tracker %s: %w", t.Announce, err)
+	}
+	if trackerResp.FailureReason != "" {
+		return nil, fmt.Errorf("tracker %s refused the announce: %s", t.Announce, trackerResp.FailureReason)
+	}
+	// Has to be echoed as trackerid on every later announce to this tracker
+	if trackerResp.TrackerID != "" {
+		t.setTrackerID(t.Announce, trackerResp.TrackerID)
+	}
 
-func parsePieceMessage(index int, buf []byte, msg *message.Message) (int, error) {
-	if msg.ID != message.MsgPiece {
-		return 0, fmt.Errorf("Expected PIECE message got %x", msg.ID)
+	if len(trackerResp.Peers)%6 != 0 {
+		return nil, fmt.Errorf("tracker %s: compact peer list length %d not a multiple of 6", t.Announce, len(trackerResp.Peers))
+	}
+	peers, err := peer.Unmarshal([]byte(trackerResp.Peers))
+	if err != nil {
+		return nil, err
 	}
-	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("Expected Payload greater than 8 got %d", len(msg.Payload))
+	if len(peers) == 0 {
+		// Trackers may answer either way whatever compact we sent
+		peers, err = dictionaryPeers(raw)
+		if err != nil {
+			return nil, fmt.Errorf("tracker %s: %w", t.Announce, err)
+		}
 	}
-	parsedIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
-	if parsedIndex != index {
-		return 0, fmt.Errorf("Got The Wrong Piece Here Expected %d", index)
+	if len(trackerResp.Peers6)%18 != 0 {
+		return nil, fmt.Errorf("tracker %s: compact peers6 list length %d not a multiple of 18", t.Announce, len(trackerResp.Peers6))
 	}
-	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-	if begin >= len(buf) {
-		return 0, fmt.Errorf("Begin is too HIGH")
+	peers6, err := peer.Unmarshal6([]byte(trackerResp.Peers6))
+	if err != nil {
+		return nil, err
 	}
-	data := msg.Payload[8:]
-	if len(data)+begin > len(buf) {
-		return 0, fmt.Errorf("Data is too long for the offset Begin %d %d", len(data), begin)
+	peers = append(peers, peers6...)
+	if cfg.OnAnnounce != nil {
+		cfg.OnAnnounce(TrackerInfo{
+			Announce: t.Announce,
+			Interval: time.Duration(trackerResp.Interval) * time.Second,
+			Seeders:  trackerResp.Complete,
+			Leechers: trackerResp.Incomplete,
+			Peers:    len(peers),
+		})
+	}
+	return peers, nil
+}
+
+// Some trackers gzip their reply whatever we ask for and not all of them say so in
+// Content-Encoding. Bencode never starts with the gzip magic so sniffing is safe.
+// The result has to be closed on its own, closing it does not close resp.Body.
+func decodeTrackerBody(resp *http.Response) (io.ReadCloser, error) {
+	body := bufio.NewReader(resp.Body)
+	magic, _ := body.Peek(2)
+	if resp.Header.Get("Content-Encoding") == "gzip" || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(body)
 	}
-	copy(buf[begin:], data)
-	return len(data), nil
+	return io.NopCloser(body), nil
 }
 
-func parseHaveMessage(msg *message.Message) (int, error) {
-	if msg.ID != message.MsgHave {
-		return 0, fmt.Errorf("Expected HAVE , got ID %d", msg.ID)
+// Reads the original BEP3 peer list, a list of dictionaries with "ip" and "port".
+// Entries with a hostname instead of an address are skipped, we only dial IPs.
+func dictionaryPeers(raw []byte) ([]peer.Peer, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
 	}
-	if len(msg.Payload) != 4 {
-		return 0, fmt.Errorf("Expected Length got %d", msg.Payload)
+	resp, _ := decoded.(map[string]interface{})
+	list, ok := resp["peers"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	var peers []peer.Peer
+	for _, entry := range list {
+		dict, _ := entry.(map[string]interface{})
+		host, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int64)
+		id, _ := dict["peer id"].(string)
+		ip := net.ParseIP(host)
+		if ip == nil || port <= 0 || port > 65535 {
+			debugLog.Printf("Skipping Tracker Peer %q Port %d", host, port)
+			continue
+		}
+		p := peer.NewPeer(ip, uint16(port))
+		if len(id) == 20 {
+			p.ID = id
+		}
+		peers = append(peers, p)
 	}
-	index := int(binary.BigEndian.Uint32(msg.Payload))
-	return index, nil
+	return peers, nil
+}
+
+func GeneratePeerID() [20]byte {
+	var id [20]byte
+	copy(id[:], "-GO0001-123456789012")
+	return id
 }
 
 type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	// Blocks an earlier worker got before its peer dropped, whoever picks the piece next only asks for the rest
+	partial  []byte
+	received []bool
 }
 
 type pieceResult struct {
 	index int
 	buf   []byte
-}
-
-type pieceProgress struct {
-	index      int
-	client     *peer.Client
-	buffer     []byte
-	downloaded int
-	requested  int
-	backlog    int
+	work  *pieceWork
 }
 
 type Torrent struct {
@@ -137,128 +232,187 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []File
+	Announce    string
+	Private     bool
+	HTTPSeeds   []string
+	// Tiers of tracker URLs from announce-list (BEP12), nil for single tracker torrents
+	AnnounceList [][]string
+	Config       Config
+	metrics      metrics
+
+	completedMu sync.Mutex
+	completed   bitfield.Bitfield
+	started     time.Time
+
+	swarmMu sync.Mutex
+	swarm   *swarm
+	known   map[string]bool
+	pacer   *dialPacer
+
+	peersMu   sync.Mutex
+	connected map[string]*connectedPeer
 }
 
-func (state *pieceProgress) checkState() error {
-	msg, err := state.client.Read()
-	if err != nil {
-		return err
-	}
-	if msg == nil {
-		return nil
-	}
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := parseHaveMessage(msg)
+func (t *Torrent) waitForUnchoke(cp *connectedPeer, timeout time.Duration, picker *piecePicker) error {
+	client := cp.client
+	client.Conn.SetDeadline(time.Now().Add(timeout))
+	defer client.Conn.SetDeadline(time.Time{})
+
+	for client.Choked {
+		msg, err := client.Read()
 		if err != nil {
-			return err
+			return fmt.Errorf("peer did not unchoke us within %s: %w", timeout, err)
 		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := parsePieceMessage(state.index, state.buffer, msg)
-		if err != nil {
-			return err
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgUnchoke:
+			client.Choked = false
+		case message.MsgExtended:
+			if len(msg.Payload) > 0 && msg.Payload[0] == 0 {
+				t.Config.handleExtendedHandshake(client, msg.Payload[1:])
+			}
+		case message.MsgHave:
+			index, err := message.ParseHaveMessage(msg)
+			if err != nil {
+				return err
+			}
+			if cp.setPiece(index) {
+				picker.addAvailability(index)
+			}
 		}
-		state.downloaded += n
-		state.backlog--
 	}
 	return nil
 }
 
-func attemptToDownloadPiece(client *peer.Client, pieceW *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pieceW.index,
-		client: client,
-		buffer: make([]byte, pieceW.length),
-	}
+var errHashMismatch = errors.New("hash mismatch")
 
-	client.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer client.Conn.SetDeadline(time.Time{})
-
-	for state.downloaded < pieceW.length {
-		if !state.client.Choked {
-			for state.backlog < MAXBACKLOG && state.requested < pieceW.length {
-				blockSize := BLOCKSIZE
-				if pieceW.length-state.requested < blockSize {
-					blockSize = pieceW.length - state.requested
-				}
-
-				err := client.SendRequest(pieceW.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-
-				state.backlog++
-				state.requested += blockSize
-			}
-		}
-
-		err := state.checkState()
-		if err != nil {
-			return nil, err
-		}
+func (t *Torrent) checkIntergrityForPiece(pieceW *pieceWork, buf []byte) error {
+	if t.Config.SkipHashCheck {
+		return nil
 	}
-
-	return state.buffer, nil
-}
-
-func checkIntergrityForPiece(pieceW *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pieceW.hash[:]) {
-		return fmt.Errorf("The Hash Check Failed For This Piece %d", pieceW.index)
+		return fmt.Errorf("The Hash Check Failed For This Piece %d: %w", pieceW.index, errHashMismatch)
 	}
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(p peer.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
+// Sleeps for the current backoff and reports false once the peer or web seed should be abandoned
+func (t *Torrent) waitBeforeReconnect(ctx context.Context, who string, backoff *time.Duration, attempts *int) bool {
+	*attempts++
+	if t.Config.MaxReconnectAttempts > 0 && *attempts >= t.Config.MaxReconnectAttempts {
+		debugLog.Printf("Giving up on %s after %d attempts", who, *attempts)
+		return false
+	}
+	if !sleepCtx(ctx, *backoff) {
+		return false
+	}
+	*backoff *= 2
+	if *backoff > t.Config.MaxBackoff {
+		*backoff = t.Config.MaxBackoff
+	}
+	return true
+}
+
+func (t *Torrent) disconnect(client *peer.Client, p peer.Peer, picker *piecePicker) {
+	client.Conn.Close()
+	t.untrackPeer(p)
+	t.metrics.peersConnected.Add(-1)
+	picker.removePeer(client.Bitfield)
+	if missing := picker.unavailable(); missing > 0 {
+		debugLog.Printf("%d Pieces Are Not Held By Any Connected Peer", missing)
+	}
+	if t.Config.OnPeerDisconnected != nil {
+		t.Config.OnPeerDisconnected(p)
+	}
+}
+
+func (t *Torrent) startDownloadWorker(p peer.Peer, s *swarm) {
+	opts, picker := s.opts, s.picker
 	backoff := time.Second
-	for {
-		client, err := peer.NewClient(p, t.PeerID, t.InfoHash)
+	attempts := 0
+	for !picker.isClosed() {
+		if !t.pacer.wait(s.ctx) {
+			return
+		}
+		client, err := peer.NewClient(p, t.PeerID, t.InfoHash, opts)
+		if errors.Is(err, peer.ErrBlocked) {
+			debugLog.Printf("Dropping Blocked Peer %s", p)
+			return
+		}
 		if err != nil {
-			debugLog.Printf("Could Not Hanshake with %s", p.IP)
-			time.Sleep(backoff)
-			if backoff < 30*time.Second {
-				backoff *= 2
+			t.metrics.recordHandshakeFailure(err)
+			debugLog.Printf("Could Not Hanshake with %s: %v", p.IP, err)
+			if !t.waitBeforeReconnect(s.ctx, p.String(), &backoff, &attempts) {
+				return
 			}
 			continue
 		}
-		backoff = time.Second
-
+		debugLog.Printf("Connected to %s: dial %s, handshake %s", p, client.DialDuration, client.HandshakeDuration)
+		if t.Config.OnPeerConnected != nil {
+			t.Config.OnPeerConnected(p)
+		}
+		t.metrics.peersConnected.Add(1)
+		if id := client.PeerID(); t.Config.CheckPeerID && p.ID != "" && p.ID != string(id[:]) {
+			log.Printf("WARNING: %s Answered With Peer ID %q But The Tracker Listed %q", p, id[:], p.ID)
+		}
+		cp := t.trackPeer(p, client)
+		// Counted before anything can call disconnect, which takes the bitfield out again
+		picker.addPeer(client.Bitfield)
+		// stopSwarm may have swept the tracked conns just before we got in
+		if s.ctx.Err() != nil {
+			t.disconnect(client, p, picker)
+			return
+		}
+		t.sendBitfield(cp)
+		if opts.Reserved[5]&reservedExtension != 0 && client.SupportsExtensionProtocol() {
+			payload, err := t.Config.localExtendedHandshake(map[string]int{})
+			if err == nil {
+				client.SendExtended(0, payload)
+			}
+		}
 		client.SendUnchoke()
 		client.SendInterested()
 
-		for pieceW := range workQueue {
-			if !client.Bitfield.CheckPiece(pieceW.index) {
-				workQueue <- pieceW
-				continue
-			}
-
-			buf, err := attemptToDownloadPiece(client, pieceW)
-			if err != nil {
-				debugLog.Println("Peer Disconnected ", err)
-				client.Conn.Close()
-				workQueue <- pieceW
-				break
+		err = t.waitForUnchoke(cp, t.Config.UnchokeTimeout, picker)
+		if err != nil {
+			debugLog.Printf("Dropping %s: %v", p.IP, err)
+			t.disconnect(client, p, picker)
+			if !t.waitBeforeReconnect(s.ctx, p.String(), &backoff, &attempts) {
+				return
 			}
+			continue
+		}
+		cp.choked.Store(false)
 
-			err = checkIntergrityForPiece(pieceW, buf)
-			if err != nil {
-				log.Println(err)
-				workQueue <- pieceW
+		err = t.downloadFromPeer(cp, s)
+		t.disconnect(client, p, picker)
+		if err == nil {
+			return
+		}
+		debugLog.Println("Peer Disconnected ", err)
+		// Only a peer that sent us data earns a fresh backoff, one that unchokes and hangs
+		// up straight away must still run out of attempts
+		if cp.downloaded.Load() > 0 {
+			backoff = time.Second
+			attempts = 0
+			// It was serving us and just hung up, worth redialing straight away. Anything
+			// else (timeouts, protocol errors) waits like a failed dial would
+			if errors.Is(err, peer.ErrPeerDisconnected) {
 				continue
 			}
-
-			client.SendHave(pieceW.index)
-			results <- &pieceResult{pieceW.index, buf}
+		}
+		if !t.waitBeforeReconnect(s.ctx, p.String(), &backoff, &attempts) {
+			return
 		}
 	}
 }
 
-func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
+// The last piece is cut off at Length, for a torrent smaller than PieceLength that is its only piece
+func (t *Torrent) CalculateBoundsForPiece(index int) (begin int, end int) {
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
 	if end > t.Length {
@@ -267,50 +421,197 @@ func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
 	return begin, end
 }
 
-func (t *Torrent) calculateLengthForPiece(index int) int {
-	begin, end := t.calculateBoundsForPiece(index)
+func (t *Torrent) CalculateLengthForPiece(index int) int {
+	begin, end := t.CalculateBoundsForPiece(index)
 	return end - begin
 }
 
 func (t *Torrent) Download() ([]byte, error) {
+	bud := make([]byte, t.Length)
+	// A fresh buffer holds none of the pieces a resume or recheck may have marked
+	t.resetCompleted()
+	err := t.DownloadTo(memoryWriter(bud))
+	if err != nil {
+		return nil, err
+	}
+	return bud, nil
+}
+
+// Also returned mid download once every peer was dropped, blocked or gave up
+var ErrNoPeers = errors.New("no peers available for this torrent")
+
+// Writes every verified piece to w at its offset in the torrent instead of holding it in memory.
+// Pieces already marked complete by LoadResume or Recheck are not downloaded again, with all
+// of them marked only the file hashes and FileManifest are checked and no peers are needed.
+func (t *Torrent) DownloadTo(w io.WriterAt) error {
+	// A hand built Torrent can list more hashes than Length covers, those pieces would be empty
+	if t.PieceLength <= 0 || (t.Length+t.PieceLength-1)/t.PieceLength != len(t.PieceHashes) {
+		return fmt.Errorf("torrent of %d bytes with %d byte pieces does not match its %d piece hashes", t.Length, t.PieceLength, len(t.PieceHashes))
+	}
+	if err := t.Config.validateBlockSize(); err != nil {
+		return err
+	}
+	if err := t.Config.validateTimeouts(); err != nil {
+		return err
+	}
+	// Fails here rather than on the first piece, after peers were already dialed
+	if s, ok := w.(*Storage); ok && s.needsCheck() {
+		return errUnverifiedFiles
+	}
+	t.initCompleted()
+	if len(t.MissingPieces()) == 0 {
+		return t.finishDownload(w, t.stats(len(t.PieceHashes), time.Time{}))
+	}
+	// Without any peers there are no workers and the results loop below would wait forever
+	t.swarmMu.Lock()
+	numPeers := len(t.Peers)
+	t.swarmMu.Unlock()
+	if numPeers == 0 && len(t.HTTPSeeds) == 0 {
+		return ErrNoPeers
+	}
+
+	opts, err := t.Config.clientOptions()
+	if err != nil {
+		return err
+	}
+	opts.Traffic = &t.metrics.traffic
+	opts.Reserved = t.reserved()
+
 	log.Println("Starting Download For", t.Name)
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+	if t.Config.SkipHashCheck {
+		log.Println("WARNING: Hash Checking Is Disabled, Pieces Are Written Without Verification")
+	}
+	started := time.Now()
+	t.completedMu.Lock()
+	t.started = started
+	t.completedMu.Unlock()
+	stopStats, err := t.serveStats()
+	if err != nil {
+		return err
+	}
+	defer stopStats()
+	var work []*pieceWork
+	downloaded := make(chan *pieceResult)
 	result := make(chan *pieceResult)
+	// Deferred in this order so the verifiers are told to stop before we wait for them
+	var verifiers sync.WaitGroup
+	defer verifiers.Wait()
+	done := make(chan struct{})
+	defer close(done)
 	for index, hash := range t.PieceHashes {
-		length := t.calculateLengthForPiece(index)
-		workQueue <- &pieceWork{index, hash, length}
+		if t.IsPieceComplete(index) {
+			continue
+		}
+		length := t.CalculateLengthForPiece(index)
+		work = append(work, &pieceWork{index: index, hash: hash, length: length})
 	}
+	picker := newPiecePicker(work, len(t.PieceHashes), t.Config.strategy(), t.Config.MaxActivePieces)
 
-	for _, p := range t.Peers {
-		go t.startDownloadWorker(p, workQueue, result)
-	}
+	t.pacer = newDialPacer(t.Config.DialsPerSecond)
+	t.startVerifiers(&verifiers, picker, downloaded, result, done)
+	s := t.startSwarm(opts, picker, downloaded)
+	defer t.stopSwarm()
 
-	bud := make([]byte, t.Length)
-	donePieces := 0
+	stall := newStallTimer(t.Config.StallTimeout)
+	defer stall.stop()
+	donePieces := len(t.PieceHashes) - len(work)
 	for donePieces < len(t.PieceHashes) {
-		res := <-result
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(bud[begin:end], res.buf)
+		var res *pieceResult
+		select {
+		case res = <-result:
+			stall.reset()
+		case <-stall.C():
+			t.logStall(picker, t.Config.StallTimeout)
+			if t.Config.AbortOnStall {
+				picker.close()
+				return fmt.Errorf("%w: no piece completed in %s", ErrStalled, t.Config.StallTimeout)
+			}
+			// Keeps reporting every StallTimeout until a piece completes
+			stall.reset()
+			continue
+		case <-s.idle:
+			if !t.exhausted(s) {
+				continue
+			}
+			picker.close()
+			return fmt.Errorf("%w: every peer was dropped or gave up with %d pieces left", ErrNoPeers, len(t.PieceHashes)-donePieces)
+		}
+		begin, _ := t.CalculateBoundsForPiece(res.index)
+		_, err := w.WriteAt(res.buf, int64(begin))
+		if err != nil {
+			picker.close()
+			return err
+		}
+		picker.release()
+		// This may have been the last piece in flight after the last worker left
+		t.wakeIfIdle()
+		t.markCompleted(res.index)
+		t.broadcastHave(res.index)
 		donePieces++
 
+		if t.Config.OnProgress != nil {
+			t.Config.OnProgress(t.stats(donePieces, started))
+			continue
+		}
 		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1
-		fmt.Printf("(%.2f%%) Downloaded Piece %d from %d peers\n", percent, res.index, numWorkers)
+		fmt.Printf("(%.2f%%) Downloaded Piece %d from %d peers\n", percent, res.index, t.metrics.peersConnected.Load())
 	}
-	close(workQueue)
-	return bud, nil
+	picker.close()
+	return t.finishDownload(w, t.stats(donePieces, started))
+}
+
+// Hashes the files read back from w when asked to, checks them against FileManifest
+// and runs OnComplete. Pieces that came from resume data go through the same checks.
+func (t *Torrent) finishDownload(w io.WriterAt, stats Stats) error {
+	if t.Config.HashFiles || t.Config.FileManifest != nil {
+		r, ok := w.(io.ReaderAt)
+		if !ok {
+			return fmt.Errorf("hashing files needs a writer that can be read back, like Storage")
+		}
+		var err error
+		stats.FileHashes, err = t.HashFiles(r)
+		if err != nil {
+			return err
+		}
+		if err := checkManifest(t.Config.FileManifest, stats.FileHashes); err != nil {
+			return err
+		}
+	}
+	if t.Config.OnComplete != nil {
+		t.Config.OnComplete(stats)
+	}
+	return nil
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+	Private     int           `bencode:"private,omitempty"`
+	Source      string        `bencode:"source,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce,omitempty"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	Info         bencodeInfo `bencode:"info"`
+	HTTPSeeds    []string    `bencode:"httpseeds,omitempty"`
+	// [host, port] pairs of DHT nodes (BEP5), what trackerless torrents have instead of announce
+	Nodes [][]interface{} `bencode:"nodes,omitempty"`
+
+	rawInfo []byte // verbatim info dictionary, set by Open
+}
+
+type File struct {
+	Path   []string
+	Length int
 }
 
 type TorrentFile struct {
@@ -320,17 +621,57 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []File
+	Private     bool
+	// Set by trackers so the same content gets a distinct infohash per tracker when cross-seeding
+	Source string
+	// Tiers of tracker URLs from announce-list (BEP12), nil for single tracker torrents
+	AnnounceList [][]string
+	// BEP17 web seeds, scripts that serve whole pieces by info_hash and piece number
+	HTTPSeeds []string
+	// host:port of DHT nodes to bootstrap from, set by trackerless torrents
+	Nodes []string
+
+	// "tracker id" each tracker handed out, shared by copies so every tier keeps its own
+	trackerIDs *trackerIDs
+}
+
+type trackerIDs struct {
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+// The tracker id announce gave us last time, empty if it never sent one
+func (t *TorrentFile) TrackerID(announce string) string {
+	if t.trackerIDs == nil {
+		return ""
+	}
+	t.trackerIDs.mu.Lock()
+	defer t.trackerIDs.mu.Unlock()
+	return t.trackerIDs.ids[announce]
+}
+
+func (t *TorrentFile) setTrackerID(announce, id string) {
+	t.trackerIDs.mu.Lock()
+	defer t.trackerIDs.mu.Unlock()
+	t.trackerIDs.ids[announce] = id
 }
 
 func (tf *TorrentFile) ToTorrent(peers []peer.Peer, peerID [20]byte) *Torrent {
 	return &Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
-		InfoHash:    tf.InfoHash,
-		PieceHashes: tf.PieceHashes,
-		PieceLength: tf.PieceLength,
-		Length:      tf.Length,
-		Name:        tf.Name,
+		Peers:        peers,
+		PeerID:       peerID,
+		InfoHash:     tf.InfoHash,
+		PieceHashes:  tf.PieceHashes,
+		PieceLength:  tf.PieceLength,
+		Length:       tf.Length,
+		Name:         tf.Name,
+		Files:        tf.Files,
+		Announce:     tf.Announce,
+		Private:      tf.Private,
+		HTTPSeeds:    tf.HTTPSeeds,
+		AnnounceList: tf.AnnounceList,
+		Config:       DefaultConfig(),
 	}
 }
 
@@ -346,7 +687,9 @@ func (i *bencodeInfo) toInfoHash() ([20]byte, error) {
 }
 
 func (i *bencodeInfo) toPieceHash() ([][20]byte, error) {
-	data := []byte(i.Pieces)
+	// Copied straight out of the string, converting to []byte first would duplicate
+	// what can be megabytes of hashes on a large torrent
+	data := i.Pieces
 	hashLen := 20
 
 	if len(data)%hashLen != 0 {
@@ -365,36 +708,154 @@ func (i *bencodeInfo) toPieceHash() ([][20]byte, error) {
 	return hashes, nil
 }
 
+// Single file torrents carry "length", multi file torrents carry "files" and the total is their sum.
+// Some hybrid torrents carry both, the files list wins as long as the two agree.
+func (i *bencodeInfo) toFiles() (int, []File, error) {
+	if len(i.Files) == 0 {
+		if i.Length <= 0 {
+			return 0, nil, fmt.Errorf("torrent has no length information")
+		}
+		return i.Length, nil, nil
+	}
+
+	total := 0
+	files := make([]File, len(i.Files))
+	for index, f := range i.Files {
+		if f.Length < 0 {
+			return 0, nil, fmt.Errorf("file %d has a negative length %d", index, f.Length)
+		}
+		if len(f.Path) == 0 {
+			return 0, nil, fmt.Errorf("file %d has an empty path", index)
+		}
+		for _, part := range f.Path {
+			if part == "" || part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+				return 0, nil, fmt.Errorf("file %d has an unsafe path %q", index, f.Path)
+			}
+		}
+		files[index] = File{Path: f.Path, Length: f.Length}
+		total += f.Length
+	}
+	if total == 0 {
+		return 0, nil, fmt.Errorf("torrent has no length information")
+	}
+	if i.Length != 0 && i.Length != total {
+		return 0, nil, fmt.Errorf("torrent length %d contradicts its files which add up to %d", i.Length, total)
+	}
+	return total, files, nil
+}
+
+// Skips entries that are not a [host, port] pair instead of failing the whole torrent
+func (bto *bencodeTorrent) nodes() []string {
+	var nodes []string
+	for _, node := range bto.Nodes {
+		if len(node) != 2 {
+			continue
+		}
+		host, ok := node[0].(string)
+		port, ok2 := node[1].(int64)
+		if !ok || !ok2 || host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	return nodes
+}
+
 func (bto *bencodeTorrent) ToTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.toInfoHash()
+	var infoHash [20]byte
+	if bto.rawInfo != nil {
+		infoHash = sha1.Sum(bto.rawInfo)
+	} else {
+		var err error
+		infoHash, err = bto.Info.toInfoHash()
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	tf, err := bto.Info.toTorrentFile(bto.Announce, infoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	tf.HTTPSeeds = bto.HTTPSeeds
+	tf.AnnounceList = bto.AnnounceList
+	tf.Nodes = bto.nodes()
+	return tf, nil
+}
+
+func (i *bencodeInfo) toTorrentFile(announce string, infoHash [20]byte) (TorrentFile, error) {
+	// Every bounds and piece count calculation divides by this
+	if i.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("invalid piece length %d", i.PieceLength)
+	}
+	if i.PieceLength&(i.PieceLength-1) != 0 {
+		log.Printf("Piece Length %d Is Not A Power Of Two, The Torrent May Be Malformed", i.PieceLength)
+	}
+	pieceHash, err := i.toPieceHash()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	pieceHash, err := bto.Info.toPieceHash()
+	length, files, err := i.toFiles()
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	// Otherwise piece bounds would point past the files, or some files would never be written
+	if want := (length + i.PieceLength - 1) / i.PieceLength; want != len(pieceHash) {
+		return TorrentFile{}, fmt.Errorf("torrent of %d bytes needs %d pieces but has %d piece hashes", length, want, len(pieceHash))
+	}
 	torFile := TorrentFile{
-		Announce:    bto.Announce,
+		Announce:    announce,
 		InfoHash:    infoHash,
 		PieceHashes: pieceHash,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		PieceLength: i.PieceLength,
+		Length:      length,
+		Name:        i.Name,
+		Files:       files,
+		Private:     i.Private == 1,
+		Source:      i.Source,
 	}
 	return torFile, nil
 }
 
 func Open(r io.Reader) (*bencodeTorrent, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
 	bto := bencodeTorrent{}
-	err := bencode.Unmarshal(r, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(raw), &bto)
 	if err != nil {
 		fmt.Println("Error")
 		return nil, err
 	}
+	bto.rawInfo, err = extractInfoDict(raw)
+	if err != nil {
+		return nil, err
+	}
 	return &bto, nil
 }
 
+func OpenBytes(data []byte) (TorrentFile, error) {
+	bto, err := Open(bytes.NewReader(data))
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return bto.ToTorrentFile()
+}
+
+func OpenFile(fsys fs.FS, name string) (TorrentFile, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	defer file.Close()
+
+	bto, err := Open(file)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return bto.ToTorrentFile()
+}
+
 func percentEncode(b []byte) string {
 	res := ""
 	for _, v := range b {
@@ -403,20 +864,59 @@ func percentEncode(b []byte) string {
 	return res
 }
 
-func (tf *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
+func (tf *TorrentFile) buildTrackerURL(peerID [20]byte, cfg Config) (string, error) {
 	base, err := url.Parse(tf.Announce)
 	if err != nil {
 		return "", err
 	}
+	if base.Host == "" {
+		return "", fmt.Errorf("announce URL %q has no host", tf.Announce)
+	}
 	params := url.Values{
-		"port":       []string{strconv.Itoa(int(port))},
+		"port":       []string{strconv.Itoa(int(cfg.announcePort()))},
 		"uploaded":   []string{"0"},
 		"downloaded": []string{"0"},
 		"compact":    []string{"1"},
 		"left":       []string{strconv.Itoa(tf.Length)},
 	}
-	base.RawQuery = params.Encode()
-	base.RawQuery += "&info_hash=" + percentEncode(tf.InfoHash[:])
-	base.RawQuery += "&peer_id=" + percentEncode(peerID[:])
-	return base.String(), nil
+	if cfg.NoCompact {
+		params.Set("compact", "0")
+	}
+	if cfg.AnnounceKey != "" {
+		params.Set("key", cfg.AnnounceKey)
+	}
+	if cfg.AnnounceIPv6 != nil {
+		params.Set("ipv6", cfg.AnnounceIPv6.String())
+	}
+	if id := tf.TrackerID(tf.Announce); id != "" {
+		params.Set("trackerid", id)
+	}
+	for key, values := range cfg.TrackerParams {
+		params[key] = values
+	}
+	// Parameters already in the announce URL (e.g. ?key=abc or a passkey) are the
+	// tracker's own, they win over ours and are kept exactly as issued
+	for key := range base.Query() {
+		params.Del(key)
+	}
+	// The binary values are escaped byte by byte and go first, url.Values would
+	// sort them in among the rest and some strict trackers look for them up front
+	query := []string{
+		"info_hash=" + percentEncode(tf.InfoHash[:]),
+		"peer_id=" + percentEncode(peerID[:]),
+	}
+	if base.RawQuery != "" {
+		query = append(query, base.RawQuery)
+	}
+	if len(params) > 0 {
+		query = append(query, params.Encode())
+	}
+
+	// Private trackers put a passkey in the path, keep it exactly as issued instead
+	// of trusting url.URL to re-escape it the same way
+	prefix := tf.Announce
+	if i := strings.IndexAny(prefix, "?#"); i != -1 {
+		prefix = prefix[:i]
+	}
+	return prefix + "?" + strings.Join(query, "&"), nil
 }
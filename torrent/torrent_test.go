@@ -0,0 +1,349 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalculateBoundsForPiece(t *testing.T) {
+	tests := []struct {
+		name        string
+		length      int
+		pieceLength int
+		index       int
+		begin, end  int
+	}{
+		{"first piece", 10000, 4096, 0, 0, 4096},
+		{"middle piece", 10000, 4096, 1, 4096, 8192},
+		{"short last piece", 10000, 4096, 2, 8192, 10000},
+		{"exact multiple first piece", 8192, 4096, 0, 0, 4096},
+		{"exact multiple last piece", 8192, 4096, 1, 4096, 8192},
+		{"single short piece", 1000, 4096, 0, 0, 1000},
+		{"single full piece", 4096, 4096, 0, 0, 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := &Torrent{Length: tt.length, PieceLength: tt.pieceLength}
+			begin, end := tor.CalculateBoundsForPiece(tt.index)
+			if begin != tt.begin || end != tt.end {
+				t.Errorf("bounds of piece %d are [%d, %d), want [%d, %d)", tt.index, begin, end, tt.begin, tt.end)
+			}
+			if got := tor.CalculateLengthForPiece(tt.index); got != tt.end-tt.begin {
+				t.Errorf("length of piece %d is %d, want %d", tt.index, got, tt.end-tt.begin)
+			}
+		})
+	}
+}
+
+// A minimal single file .torrent around a hand written info dictionary body
+func rawTorrent(infoKeys string) []byte {
+	return []byte("d8:announce28:http://tracker.test/announce4:infod" + infoKeys + "ee")
+}
+
+func TestSourceChangesInfoHash(t *testing.T) {
+	pieces := "6:pieces20:" + strings.Repeat("a", 20)
+	common := "6:lengthi100e4:name4:test12:piece lengthi16384e" + pieces
+
+	plain, err := OpenBytes(rawTorrent(common))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := OpenBytes(rawTorrent(common + "6:source7:TRACKER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := OpenBytes(rawTorrent(common + "6:source5:OTHER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Source != "TRACKER" || second.Source != "OTHER" || plain.Source != "" {
+		t.Errorf("sources are %q, %q and %q", first.Source, second.Source, plain.Source)
+	}
+	if first.InfoHash == second.InfoHash || first.InfoHash == plain.InfoHash {
+		t.Error("the source key did not change the infohash")
+	}
+}
+
+func TestBuildTrackerURL(t *testing.T) {
+	tf := TorrentFile{
+		Announce: "http://tracker.test:8080/announce",
+		InfoHash: [20]byte{0x12, 0x34, ' ', '&', 0xff},
+		Length:   12345,
+	}
+	peerID := [20]byte{'-', 'G', 'O'}
+	cfg := DefaultConfig()
+	cfg.AnnounceKey = "cafe"
+	cfg.TrackerParams = url.Values{"passkey": {"secret"}, "port": {"51413"}}
+
+	raw, err := tf.buildTrackerURL(peerID, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, "http://tracker.test:8080/announce?info_hash=%12%34%20%26%FF%00") {
+		t.Errorf("info_hash does not come first: %s", raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	want := map[string]string{
+		"info_hash":  string(tf.InfoHash[:]),
+		"peer_id":    string(peerID[:]),
+		"left":       "12345",
+		"uploaded":   "0",
+		"downloaded": "0",
+		"compact":    "1",
+		"key":        "cafe",
+		"passkey":    "secret",
+		"port":       "51413",
+	}
+	for key, value := range want {
+		if got := query[key]; len(got) != 1 || got[0] != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if len(query) != len(want) {
+		t.Errorf("got parameters %v", query)
+	}
+
+	tf.Announce = "/announce"
+	if _, err := tf.buildTrackerURL(peerID, cfg); err == nil {
+		t.Error("expected an error for an announce URL without a host")
+	}
+}
+
+func TestBuildTrackerURLWithQuery(t *testing.T) {
+	tf := TorrentFile{Announce: "http://tracker.test/announce?key=abc&passkey=x%2Fy#frag", Length: 1}
+	cfg := DefaultConfig()
+	cfg.AnnounceKey = "ours"
+	cfg.TrackerParams = url.Values{"passkey": {"mine"}, "event": {"started"}}
+
+	raw, err := tf.buildTrackerURL([20]byte{'p'}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tracker's own parameters come right after ours and are kept exactly as issued
+	if !strings.HasPrefix(raw, "http://tracker.test/announce?info_hash=") ||
+		!strings.Contains(raw, "&peer_id=%70%00") ||
+		!strings.Contains(raw, "%00&key=abc&passkey=x%2Fy&") {
+		t.Errorf("unexpected layout: %s", raw)
+	}
+	if strings.Contains(raw, "#") || strings.Contains(raw, "frag") {
+		t.Errorf("fragment was kept: %s", raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	want := map[string]string{"key": "abc", "passkey": "x/y", "event": "started", "compact": "1"}
+	for key, value := range want {
+		if got := query[key]; len(got) != 1 || got[0] != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestBuildTrackerURLKeepsPasskeyPath(t *testing.T) {
+	for _, announce := range []string{
+		"https://tracker.test/0123456789abcdef/announce",
+		"https://tracker.test/a%2Fb%3Dc/announce",
+		"https://tracker.test/announce.php/PASSKEY",
+		"http://tracker.test:2710/%7Euser/announce",
+	} {
+		tf := TorrentFile{Announce: announce, Length: 1}
+		raw, err := tf.buildTrackerURL([20]byte{}, DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(raw, announce+"?") {
+			t.Errorf("%s was rebuilt as %s", announce, raw)
+		}
+	}
+}
+
+func TestZeroPieceLengthIsRejected(t *testing.T) {
+	for _, pieceLength := range []string{"0", "-16384"} {
+		raw := rawTorrent("6:lengthi100e4:name4:test12:piece lengthi" + pieceLength + "e6:pieces20:" + strings.Repeat("a", 20))
+		_, err := OpenBytes(raw)
+		if err == nil || !strings.Contains(err.Error(), "piece length") {
+			t.Errorf("piece length %s: got %v, want an invalid piece length error", pieceLength, err)
+		}
+	}
+}
+
+func TestMultiFileLengthMustMatchPieces(t *testing.T) {
+	files := "5:filesld6:lengthi10000e4:pathl1:aeed6:lengthi10000e4:pathl1:beee"
+	tests := []struct {
+		name    string
+		pieces  int
+		wantErr bool
+	}{
+		{"consistent", 2, false},
+		{"too few hashes", 1, true},
+		{"too many hashes", 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashes := strings.Repeat("a", 20*tt.pieces)
+			raw := rawTorrent(files + "4:name4:test12:piece lengthi16384e6:pieces" + strconv.Itoa(len(hashes)) + ":" + hashes)
+			tf, err := OpenBytes(raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("accepted %d bytes in %d pieces", tf.Length, len(tf.PieceHashes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tf.Length != 20000 || len(tf.Files) != 2 {
+				t.Errorf("got length %d and %d files", tf.Length, len(tf.Files))
+			}
+		})
+	}
+}
+
+func bencodeString(s string) string {
+	return strconv.Itoa(len(s)) + ":" + s
+}
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func TestRequestPeersResponses(t *testing.T) {
+	compact := string([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2})
+	compact6 := string(append(net.ParseIP("2001:db8::1").To16(), 0x1a, 0xe1))
+	peerID := strings.Repeat("p", 20)
+	dictionary := "d8:intervali900e5:peersl" +
+		"d2:ip" + bencodeString("10.0.0.3") + "7:peer id" + bencodeString(peerID) + "4:porti6883ee" +
+		"d2:ip" + bencodeString("peer.example") + "4:porti6884ee" +
+		"ee"
+
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+		peers    []string
+		wantErr  string
+	}{
+		{"compact", "d8:completei5e10:incompletei7e8:intervali900e5:peers" + bencodeString(compact) + "e",
+			"", []string{"10.0.0.1:6881", "10.0.0.2:6882"}, ""},
+		{"compact and peers6", "d8:intervali900e5:peers" + bencodeString(compact[:6]) + "6:peers6" + bencodeString(compact6) + "e",
+			"", []string{"10.0.0.1:6881", "[2001:db8::1]:6881"}, ""},
+		{"dictionary peers", dictionary, "", []string{"10.0.0.3:6883"}, ""},
+		{"gzip announced", gzipped(dictionary), "gzip", []string{"10.0.0.3:6883"}, ""},
+		{"gzip not announced", gzipped(dictionary), "", []string{"10.0.0.3:6883"}, ""},
+		{"no peers", "d8:intervali900e5:peers0:e", "", nil, ""},
+		{"failure reason", "d14:failure reason" + bencodeString("unregistered torrent") + "e", "", nil, "unregistered torrent"},
+		{"broken compact list", "d8:intervali900e5:peers" + bencodeString(compact[:7]) + "e", "", nil, "not a multiple of 6"},
+		{"not bencode", "<html>502 Bad Gateway</html>", "", nil, "tracker"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			var info TrackerInfo
+			cfg := DefaultConfig()
+			cfg.HTTPClient = srv.Client()
+			cfg.OnAnnounce = func(i TrackerInfo) { info = i }
+			tf := TorrentFile{Announce: srv.URL + "/announce", Length: 1}
+			peers, err := RequestPeers(&tf, [20]byte{}, cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range peers {
+				got = append(got, p.String())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.peers, " ") {
+				t.Errorf("got peers %v, want %v", got, tt.peers)
+			}
+			if tt.name == "dictionary peers" && peers[0].ID != peerID {
+				t.Errorf("peer id %q was not kept", peers[0].ID)
+			}
+			if tt.name == "compact" && (info.Seeders != 5 || info.Leechers != 7 || info.Interval != 900*time.Second) {
+				t.Errorf("OnAnnounce got %+v", info)
+			}
+		})
+	}
+}
+
+// Parsing a torrent with 50,000 pieces, about 1 MB of piece hashes
+func BenchmarkOpenBytesManyPieces(b *testing.B) {
+	const numPieces = 50000
+	const pieceLength = 16384
+	hashes := strings.Repeat("0123456789abcdefghij", numPieces)
+	raw := rawTorrent("6:lengthi" + strconv.Itoa(numPieces*pieceLength) + "e4:name4:test12:piece lengthi" +
+		strconv.Itoa(pieceLength) + "e6:pieces" + bencodeString(hashes))
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for b.Loop() {
+		tf, err := OpenBytes(raw)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(tf.PieceHashes) != numPieces {
+			b.Fatalf("got %d pieces", len(tf.PieceHashes))
+		}
+	}
+}
+
+// Just the split of the pieces string into hashes, without bencode decoding around it
+func BenchmarkToPieceHash(b *testing.B) {
+	info := bencodeInfo{Pieces: strings.Repeat("0123456789abcdefghij", 50000)}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := info.toPieceHash(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDictionaryPeersStoreIPv4InFourBytes(t *testing.T) {
+	raw := "d5:peersl" +
+		"d2:ip" + bencodeString("::ffff:10.0.0.1") + "4:porti6881ee" +
+		"d2:ip" + bencodeString("10.0.0.2") + "4:porti6881ee" +
+		"d2:ip" + bencodeString("2001:db8::1") + "4:porti6881ee" +
+		"ee"
+	peers, err := dictionaryPeers([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{4, 4, 16}
+	if len(peers) != len(want) {
+		t.Fatalf("got %d peers, want %d", len(peers), len(want))
+	}
+	for i, p := range peers {
+		if len(p.IP) != want[i] {
+			t.Errorf("%s is stored in %d bytes, want %d", p, len(p.IP), want[i])
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// Hashes finished pieces on VerifyWorkers goroutines so a fast swarm is not held
+// up by SHA-1 in the peer workers. Good pieces go on to results, bad ones back to the picker.
+// A good piece keeps its picker slot until DownloadTo has written it.
+func (t *Torrent) startVerifiers(wg *sync.WaitGroup, picker *piecePicker, downloaded <-chan *pieceResult, results chan<- *pieceResult, done <-chan struct{}) {
+	for range max(t.Config.VerifyWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var res *pieceResult
+				select {
+				case res = <-downloaded:
+				case <-done:
+					return
+				}
+				err := t.checkIntergrityForPiece(res.work, res.buf)
+				if errors.Is(err, errHashMismatch) {
+					log.Println(err)
+					picker.requeue(res.work)
+					picker.release()
+					t.wakeIfIdle()
+					continue
+				}
+				select {
+				case results <- res:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+}
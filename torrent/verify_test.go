@@ -0,0 +1,47 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Pushes 256 KiB pieces through the verifiers the way DownloadTo does, once per worker count
+func BenchmarkVerifiers(b *testing.B) {
+	const pieceLength = 256 * 1024
+	data := testData(64 * pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+	var work []*pieceWork
+	for index, hash := range tor.PieceHashes {
+		work = append(work, &pieceWork{index: index, hash: hash, length: pieceLength})
+	}
+
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tor.Config.VerifyWorkers = workers
+			picker := newPiecePicker(work, len(work), RarestFirst{}, 0)
+			downloaded := make(chan *pieceResult)
+			results := make(chan *pieceResult)
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			tor.startVerifiers(&wg, picker, downloaded, results, done)
+			defer func() {
+				close(done)
+				wg.Wait()
+			}()
+
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				go func() {
+					for _, pw := range work {
+						begin := pw.index * pieceLength
+						downloaded <- &pieceResult{pw.index, data[begin : begin+pieceLength], pw}
+					}
+				}()
+				for range work {
+					<-results
+				}
+			}
+		})
+	}
+}